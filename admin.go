@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serveAdmin runs the admin server on addr (ADMIN_ADDR). It serves /metrics
+// and /channels; the /builds JSON endpoint and the / dashboard need the build
+// history (BUILD_HISTORY), /replay, /announce and the /channels/{name}
+// toggles need ADMIN_TOKEN.
+func serveAdmin(addr string, processor *Processor) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/channels", channelsHandler(processor))
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		secrets.add(token)
+		mux.Handle("/replay", requireToken(token, replayHandler(processor)))
+		mux.Handle("/announce", requireToken(token, announceHandler(processor)))
+		mux.Handle("/channels/", requireToken(token, toggleChannelHandler(processor)))
+	}
+	if processor.history != nil {
+		refresh := getEnvDuration("DASHBOARD_REFRESH", 30*time.Second)
+		mux.HandleFunc("/builds", buildsHandler(processor.history))
+		mux.HandleFunc("/", dashboardHandler(processor.history, int(refresh.Seconds())))
+	}
+	log.Printf("Admin server listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// requireToken only lets through requests bearing the admin token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// replayHandler fetches a past build from the Cloud Build API and notifies it
+// again, bypassing dedup: POST /replay?buildId=...[&project=...&location=...].
+// The project defaults to PROJECT_ID and the location to POLL_LOCATION. The
+// rule's Delay is skipped, so it responds once the notification is sent.
+func replayHandler(processor *Processor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		buildID := query.Get("buildId")
+		if buildID == "" {
+			http.Error(w, "buildId is required", http.StatusBadRequest)
+			return
+		}
+		project, location := query.Get("project"), query.Get("location")
+		if project == "" {
+			project = os.Getenv("PROJECT_ID")
+		}
+		if location == "" {
+			location = os.Getenv("POLL_LOCATION")
+		}
+		api, err := NewCloudBuildClient(r.Context(), project, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		build, err := api.GetBuild(r.Context(), buildID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Replaying build %s of %s", buildID, project)
+		if err := processor.Replay(r.Context(), build); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "Replayed build %s\n", buildID)
+	}
+}
+
+// announceHandler posts an operator message, such as a maintenance notice,
+// to a channel: POST /announce {"channel": "hangout", "message": "..."}.
+func announceHandler(processor *Processor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var announcement struct {
+			Channel string `json:"channel"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&announcement); err != nil || announcement.Message == "" {
+			http.Error(w, "expected {\"channel\": ..., \"message\": ...}", http.StatusBadRequest)
+			return
+		}
+		if announcement.Channel == "" {
+			announcement.Channel = legacyChannel
+		}
+		ch, ok := processor.channels[announcement.Channel]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown channel %q", announcement.Channel), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Announcing to %s: %s", ch.name, announcement.Message)
+		if err := processor.deliver(r.Context(), ch, announcement.Message, MessageData{}); errors.Is(err, ErrChannelDisabled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// channelState is a channel as listed by GET /channels.
+type channelState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// channelsHandler lists the channels and whether they are enabled.
+func channelsHandler(processor *Processor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		states := make([]channelState, 0, len(processor.channels))
+		for name, ch := range processor.channels {
+			states = append(states, channelState{Name: name, Enabled: !ch.disabled.Load()})
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+	}
+}
+
+// toggleChannelHandler silences a channel, e.g. during an incident, or
+// turns it back on: POST /channels/{name}/disable or /channels/{name}/enable.
+// The state is kept in memory, so a restart enables every channel again.
+func toggleChannelHandler(processor *Processor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/channels/"), "/")
+		if len(parts) != 2 || (parts[1] != "enable" && parts[1] != "disable") {
+			http.Error(w, "expected /channels/{name}/enable or /channels/{name}/disable", http.StatusNotFound)
+			return
+		}
+		ch, ok := processor.channels[parts[0]]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown channel %q", parts[0]), http.StatusNotFound)
+			return
+		}
+		ch.disabled.Store(parts[1] == "disable")
+		log.Printf("Channel %s %sd from the admin server", ch.name, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func buildsHandler(history *BuildHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history.Recent())
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Cloud Build notifications</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #ddd; }
+.SUCCESS { color: #188038; }
+.FAILURE, .INTERNAL_ERROR, .TIMEOUT { color: #d93025; }
+.CANCELLED, .EXPIRED { color: #80868b; }
+.QUEUED, .WORKING { color: #1a73e8; }
+</style>
+</head>
+<body>
+<h1>Recent builds</h1>
+<table>
+<tr><th>Finished</th><th>Repo</th><th>Branch</th><th>Status</th><th>Notification</th><th>Build</th></tr>
+{{range .Builds}}<tr>
+<td>{{if not .FinishTime.IsZero}}{{.FinishTime.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{.Repo}}</td>
+<td>{{.Branch}}</td>
+<td class="{{.Status}}">{{.Status}}</td>
+<td>{{.Outcome}}{{with .Error}}: {{.}}{{end}}</td>
+<td>{{if .LogURL}}<a href="{{.LogURL}}">{{.ID}}</a>{{else}}{{.ID}}{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="6">No builds processed yet.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func dashboardHandler(history *BuildHistory, refresh int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := dashboardTemplate.Execute(w, struct {
+			Refresh int
+			Builds  []BuildRecord
+		}{refresh, history.Recent()})
+		if err != nil {
+			log.Printf("Could not render dashboard: %v", err)
+		}
+	}
+}
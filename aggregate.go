@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AggregatedBuild is one of the builds of a commit combined into a single
+// message by a rule's AggregateWindow.
+type AggregatedBuild struct {
+	Name         string
+	Repo         string
+	Branch       string
+	Status       string
+	FailureStep  string
+	ShortBuildId string
+	LogURL       string
+}
+
+// Failed reports whether the build did not succeed, for templates to
+// highlight it.
+func (b AggregatedBuild) Failed() bool {
+	return b.Status != "SUCCESS"
+}
+
+// aggregator buffers the notifications of the builds of a commit, e.g. the
+// parallel triggers of a monorepo push, for a window after the first one and
+// then sends them as one message. It also collects the builds of a Digest
+// and the notifications held back during quiet hours.
+type aggregator struct {
+	mu     sync.Mutex
+	clock  Clock
+	groups map[string]*aggregateGroup
+}
+
+type aggregateGroup struct {
+	// first is the first notification, which the combined message is
+	// rendered from.
+	first    MessageData
+	strategy string
+	channels []string
+	builds   []AggregatedBuild
+	// expected sends the group as soon as that many builds were added.
+	expected int
+	send     func(g *aggregateGroup)
+}
+
+func newAggregator(clock Clock) *aggregator {
+	return &aggregator{clock: clock, groups: make(map[string]*aggregateGroup)}
+}
+
+// add buffers a notification for key, with the build named name. The first
+// one for a key opens a window of d; when it ends, or once expected builds
+// were added if it is not zero, send is called with everything added.
+func (a *aggregator) add(key, name string, d time.Duration, expected int, strategy string, channels []string, data MessageData, send func(g *aggregateGroup)) {
+	build := AggregatedBuild{
+		Name:         name,
+		Repo:         data.Repo,
+		Branch:       data.Branch,
+		Status:       data.Status,
+		FailureStep:  data.FailureStep,
+		ShortBuildId: data.ShortBuildId,
+	}
+	if data.Build != nil {
+		build.LogURL = data.Build.LogURL
+	}
+	a.mu.Lock()
+	g, ok := a.groups[key]
+	if ok {
+		g.builds = append(g.builds, build)
+		if g.first.Mention == "" {
+			g.first.Mention = data.Mention
+		}
+		for _, name := range channels {
+			if !contains(g.channels, name) {
+				g.channels = append(g.channels, name)
+			}
+		}
+	} else {
+		g = &aggregateGroup{first: data, strategy: strategy, channels: append([]string{}, channels...), builds: []AggregatedBuild{build}, expected: expected, send: send}
+		a.groups[key] = g
+		a.clock.AfterFunc(d, func() {
+			if a.take(key, g) {
+				send(g)
+			}
+		})
+	}
+	complete := g.expected > 0 && len(g.builds) >= g.expected && a.groups[key] == g
+	if complete {
+		delete(a.groups, key)
+	}
+	a.mu.Unlock()
+	if complete {
+		send(g)
+	}
+}
+
+// take removes g, unless it was already sent.
+func (a *aggregator) take(key string, g *aggregateGroup) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.groups[key] != g {
+		return false
+	}
+	delete(a.groups, key)
+	return true
+}
+
+// takeAll removes every group before its window ends, e.g. on shutdown.
+func (a *aggregator) takeAll() map[string]*aggregateGroup {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	groups := a.groups
+	a.groups = make(map[string]*aggregateGroup)
+	return groups
+}
+
+// aggregateName names a build in a combined message by its rule's build
+// type, its trigger or, failing both, its id.
+func aggregateName(data MessageData) string {
+	if data.BuildType != "" {
+		return data.BuildType
+	}
+	if data.Build != nil {
+		if name := data.Build.Substitutions.Get("TRIGGER_NAME"); name != "" {
+			return name
+		}
+	}
+	return data.ShortBuildId
+}
+
+// sendAggregate sends the combined message of the builds of a commit.
+func (p *Processor) sendAggregate(g *aggregateGroup) {
+	data := g.first
+	data.Builds = g.builds
+	sort.SliceStable(data.Builds, func(i, j int) bool { return data.Builds[i].Failed() && !data.Builds[j].Failed() })
+	data.Status = "SUCCESS"
+	for _, b := range g.builds {
+		if b.Failed() {
+			data.Status = b.Status
+			break
+		}
+	}
+	if _, err := p.dispatchWith(context.Background(), g.strategy, g.channels, aggregateTemplate, nil, data); err != nil {
+		log.Printf("Could not send the combined notification for %s on %s: %v", data.Repo, data.Branch, err)
+	}
+}
+
+// sendDigest sends the summary of the builds of a pipeline run.
+func (p *Processor) sendDigest(d *Digest, run string, g *aggregateGroup) {
+	data := g.first
+	data.Builds = g.builds
+	data.Digest = d.Name
+	if data.Digest == "" {
+		data.Digest = run
+	}
+	if d.Expected > len(g.builds) {
+		data.Missing = d.Expected - len(g.builds)
+	}
+	data.Status = "SUCCESS"
+	if len(data.FailedBuilds()) > 0 {
+		data.Status = "FAILURE"
+	}
+	text := digestTemplate
+	if d.Template != "" {
+		text = d.Template
+	}
+	if _, err := p.dispatchWith(context.Background(), g.strategy, g.channels, text, nil, data); err != nil {
+		log.Printf("Could not send the digest of %s: %v", data.Digest, err)
+	}
+}
@@ -1,3 +1,3 @@
-docker build -t cloudbuild --target app .
+docker build -t cloudbuild --target app --build-arg VERSION=$(git describe --tags --always --dirty) .
 docker rmi $(docker images -f "dangling=true" -q)
 docker run -d cloudbuild
\ No newline at end of file
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2/google"
+)
+
+const cloudBuildAPI = "https://cloudbuild.googleapis.com/v1"
+
+// CloudBuildClient calls the Cloud Build REST API with the application
+// default credentials.
+type CloudBuildClient struct {
+	client *http.Client
+	// parent is "projects/{project}" or, for regional builds,
+	// "projects/{project}/locations/{location}".
+	parent string
+}
+
+func NewCloudBuildClient(ctx context.Context, project, location string) (*CloudBuildClient, error) {
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	parent := "projects/" + project
+	if location != "" {
+		parent += "/locations/" + location
+	}
+	return &CloudBuildClient{client: client, parent: parent}, nil
+}
+
+// ListBuilds returns the raw JSON of every build matching filter, e.g.
+// `create_time>"2020-04-01T00:00:00Z"`, newest first.
+func (c *CloudBuildClient) ListBuilds(ctx context.Context, filter string) ([]json.RawMessage, error) {
+	var builds []json.RawMessage
+	pageToken := ""
+	for {
+		query := url.Values{"filter": {filter}, "pageSize": {"100"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Builds        []json.RawMessage `json:"builds"`
+			NextPageToken string            `json:"nextPageToken"`
+		}
+		if err := c.get(ctx, fmt.Sprintf("%s/%s/builds?%s", cloudBuildAPI, c.parent, query.Encode()), &page); err != nil {
+			return nil, err
+		}
+		builds = append(builds, page.Builds...)
+		if page.NextPageToken == "" {
+			return builds, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// GetBuild returns the raw JSON of the build id.
+func (c *CloudBuildClient) GetBuild(ctx context.Context, id string) (json.RawMessage, error) {
+	var build json.RawMessage
+	if err := c.get(ctx, fmt.Sprintf("%s/%s/builds/%s", cloudBuildAPI, c.parent, url.PathEscape(id)), &build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (c *CloudBuildClient) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCloudBuildUnavailable, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return &StatusError{Service: "cloudbuild", StatusCode: res.StatusCode, Kind: ErrCloudBuildUnavailable}
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const usage = `Usage: cloudbuild [command] [flags]
+
+Commands:
+  run          receive Cloud Build notifications (default)
+  validate     check the config file
+  test-notify  send a test message to a channel
+  replay       process a saved Cloud Build message
+
+Run "cloudbuild <command> -h" for the flags of a command.
+`
+
+func runCommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	mode := flags.String("mode", os.Getenv("MODE"), "pull, push or poll (default pull, or $MODE)")
+	subscription := flags.String("subscription", "cloudBuildSub", "pubsub subscription to pull from")
+	flags.Parse(args)
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Could not load config: %v", err)
+	}
+	if err := config.checkWebhooks(); err != nil {
+		return err
+	}
+	processor := NewProcessor(config)
+	if err := processor.useSharedState(); err != nil {
+		return err
+	}
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		go func() {
+			if err := serveAdmin(addr, processor); err != nil {
+				log.Printf("Admin server stopped: %v", err)
+			}
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = superviseMode(ctx, *mode, *subscription, processor)
+	if ctx.Err() != nil {
+		processor.flushPending()
+		processor.shutdownSummary()
+	}
+	return err
+}
+
+// Values of ON_RECEIVE_ERROR, what to do when receiving messages fails, e.g.
+// the subscription was deleted or credentials expired.
+const (
+	// receiveErrorExit exits with status 1 so the orchestrator restarts the
+	// container; it is the default.
+	receiveErrorExit = "exit"
+	// receiveErrorRetry keeps the process up and starts receiving again
+	// with a backoff doubling from 1s up to RECEIVE_RETRY_MAX_BACKOFF
+	// (default 5m), e.g. while a subscription is being migrated.
+	receiveErrorRetry = "retry"
+	// receiveErrorCode exits with RECEIVE_ERROR_EXIT_CODE (default 3), for
+	// orchestrators that treat it differently from a crash.
+	receiveErrorCode = "code"
+)
+
+// exitError makes main exit with a specific status.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// superviseMode runs runMode and handles its failure as ON_RECEIVE_ERROR
+// says.
+func superviseMode(ctx context.Context, mode, subscription string, processor *Processor) error {
+	onError := os.Getenv("ON_RECEIVE_ERROR")
+	backoff, maxBackoff := time.Second, getEnvDuration("RECEIVE_RETRY_MAX_BACKOFF", 5*time.Minute)
+	for {
+		err := runMode(ctx, mode, subscription, processor)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		switch onError {
+		case "", receiveErrorExit:
+			return err
+		case receiveErrorCode:
+			return &exitError{code: getEnvInt("RECEIVE_ERROR_EXIT_CODE", 3), err: err}
+		case receiveErrorRetry:
+		default:
+			log.Printf("Ignoring invalid ON_RECEIVE_ERROR=%q", onError)
+			return err
+		}
+		log.Printf("Receiving failed, starting again in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runMode receives builds in mode until ctx is cancelled.
+func runMode(ctx context.Context, mode, subscription string, processor *Processor) error {
+	switch mode {
+	case "", "pull":
+		proj := os.Getenv("PROJECT_ID")
+		client, err := pubsub.NewClient(ctx, proj)
+		if err != nil {
+			return fmt.Errorf("Could not create pubsub Client: %v", err)
+		}
+		// superviseMode creates a new client on every restart.
+		defer client.Close()
+		deadLetter, err := newDeadLetter(client, processor.channels)
+		if err != nil {
+			return err
+		}
+		processor.redeliver = true
+		// Pull messages via the subscription.
+		log.Printf("Starting collect notify from cloudbuild server...")
+		return pullMsgs(ctx, client, subscription, processor, deadLetter)
+	case "push":
+		// Only a DEADLETTER_TOPIC needs a client in push mode.
+		var client *pubsub.Client
+		if os.Getenv("DEADLETTER_TOPIC") != "" {
+			var err error
+			if client, err = pubsub.NewClient(ctx, os.Getenv("PROJECT_ID")); err != nil {
+				return fmt.Errorf("Could not create pubsub Client: %v", err)
+			}
+			defer client.Close()
+		}
+		deadLetter, err := newDeadLetter(client, processor.channels)
+		if err != nil {
+			return err
+		}
+		processor.redeliver = true
+		return servePush(ctx, processor, deadLetter)
+	case "poll":
+		api, err := NewCloudBuildClient(ctx, os.Getenv("PROJECT_ID"), os.Getenv("POLL_LOCATION"))
+		if err != nil {
+			return fmt.Errorf("Could not create cloudbuild client: %v", err)
+		}
+		interval := getEnvDuration("POLL_INTERVAL", time.Minute)
+		log.Printf("Polling cloudbuild builds every %s...", interval)
+		err = NewPoller(api, processor, interval).Run(ctx)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("Unknown mode %q, expected pull, push or poll", mode)
+}
+
+func validateCommand(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("config", "", "config file to check (default $APP_CONFIG or $CONFIG_FILE)")
+	snapshots := flags.String("snapshot-test", "", "directory of Cloud Build message JSON files to render in dry run")
+	flags.Parse(args)
+
+	loadConfig := LoadConfig
+	if *path != "" {
+		loadConfig = func() (*Config, error) { return LoadConfigFile(*path) }
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if *snapshots != "" {
+		return snapshotTest(config, *snapshots, os.Stdout)
+	}
+	if err := config.checkWebhooks(); err != nil {
+		return err
+	}
+	fmt.Printf("Config OK: %d rules, %d channels\n", len(config.Rules), len(newChannels(config)))
+	return nil
+}
+
+func testNotifyCommand(args []string) error {
+	flags := flag.NewFlagSet("test-notify", flag.ExitOnError)
+	name := flags.String("channel", legacyChannel, "channel to send to")
+	message := flags.String("message", "Test notification from cloudbuildnotifier "+version, "message text")
+	flags.Parse(args)
+
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	ch, ok := newChannels(config)[*name]
+	if !ok {
+		return fmt.Errorf("%w: unknown channel %q", ErrConfig, *name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ch.timeout)
+	defer cancel()
+	return ch.notifier.Notify(ctx, *message, MessageData{})
+}
+
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := flags.String("file", "", "Cloud Build message JSON to process (default stdin)")
+	dryRun := flags.Bool("dry-run", false, "print the notifications instead of sending them")
+	flags.Parse(args)
+
+	var data []byte
+	var err error
+	if *file == "" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	processor := NewProcessor(config)
+	processor.dryRun = *dryRun
+	return processor.Replay(context.Background(), data)
+}
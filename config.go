@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes which builds are announced and how. It is loaded from the
+// JSON file named by CONFIG_FILE, or from the APP_CONFIG environment variable
+// holding the JSON itself; without either the built-in rules are used, which
+// reproduce the original superset/ProjectStrand notifications.
+type Config struct {
+	// DefaultBranches applies to rules that don't list their own branches.
+	// It defaults to dev and master.
+	DefaultBranches []string `json:"default_branches"`
+	// CriticalRepos notify about every branch: their rules, including a
+	// catch-all rule, behave as if they set AllBranches. As rules match
+	// first-wins, the first rule of such a repo whose statuses and
+	// conditions match takes builds of every branch, so put branch-specific
+	// rules for it in Conditions rather than Branches.
+	CriticalRepos []string `json:"critical_repos"`
+	// Channels are the named notification targets rules send to. The
+	// HANGOUT_URL webhook is always available as channel "hangout".
+	Channels map[string]ChannelConfig `json:"channels"`
+	// HangoutURLs is a shorthand for hangout channels: each named webhook is
+	// a channel rules can target, e.g. {"frontend": "https://chat..."}.
+	HangoutURLs map[string]string `json:"hangout_urls"`
+	// IgnoreAuthors suppresses builds of commits whose author name or email
+	// matches one of these patterns, e.g. "*[bot]*". "*" is the only
+	// wildcard and matching ignores case.
+	IgnoreAuthors []string `json:"ignore_authors"`
+	// InternalDomains and InternalLogins tell the organization's commits
+	// apart: an author whose email domain or GitHub login (a pattern as in
+	// IgnoreAuthors) is listed is internal, any other is external, e.g. a
+	// fork contributor. Logins need the default /commits endpoint or GraphQL.
+	// Without either list every author is internal.
+	InternalDomains []string `json:"internal_domains"`
+	InternalLogins  []string `json:"internal_logins"`
+	Rules           []Rule   `json:"rules"`
+	// RepoSources, BranchSources and CommitSources list where to read the
+	// repo name, branch and commit SHA of a build, first non-empty wins:
+	// "substitution:_REPO_NAME", "tag:repo-" (the rest of the first tag with
+	// that prefix) or a source field such as "source.repoSource.repoName".
+	// They default to the REPO_NAME, BRANCH_NAME and COMMIT_SHA substitutions.
+	RepoSources   []string `json:"repo_sources"`
+	BranchSources []string `json:"branch_sources"`
+	CommitSources []string `json:"commit_sources"`
+	// CommitIdentity shows the commit "author", "committer" or "both" (the
+	// default) in notifications.
+	CommitIdentity string `json:"commit_identity"`
+	// QuietHours holds back notifications other than failures, e.g. at night.
+	QuietHours *QuietHours `json:"quiet_hours"`
+	// CommitURLTemplate, when set, replaces GitHub's commit URL in
+	// notifications, e.g. "https://ui.internal/{{.Repo}}/commit/{{.Sha}}".
+	// It is rendered with Repo, Branch and Sha.
+	CommitURLTemplate string `json:"commit_url_template"`
+	// DefaultTemplate is the template of rules that have none; it defaults
+	// to the built-in defaultTemplate.
+	DefaultTemplate string `json:"default_template"`
+	// FailureCategories classify failed builds, first match wins; the
+	// runbook of the category is linked in the notification.
+	FailureCategories []FailureCategory `json:"failure_categories"`
+	// SecretSubstitutions are patterns, as in IgnoreAuthors, of substitution
+	// names never shown by ShowSubstitutions rules. They default to names
+	// containing TOKEN, SECRET, PASSWORD or KEY.
+	SecretSubstitutions []string `json:"secret_substitutions"`
+	// StatusTexts override the {{.StatusText}} phrases of statuses per
+	// locale, e.g. {"en": {"FAILURE": "broke"}}.
+	StatusTexts map[string]map[string]string `json:"status_texts"`
+	// Timezone is where days start and end for FirstDeployOfDay rules, e.g.
+	// "Asia/Ho_Chi_Minh"; it defaults to the server's local time.
+	Timezone string `json:"timezone"`
+	loc      *time.Location
+	// ChatUsers maps commit author emails and GitHub logins to chat user
+	// ids, e.g. {"alice@example.com": "users/123456789"}, to mention the
+	// author of a failed build in MentionAuthor rules. Keys ignore case.
+	// Ids of the form "users/..." become Google Chat mentions; any other
+	// value, such as "@alice", is used as is.
+	ChatUsers map[string]string `json:"chat_users"`
+	// OnCallMention is mentioned instead when the author is not in
+	// ChatUsers, e.g. "<users/all>"; without it nobody is.
+	OnCallMention string `json:"on_call_mention"`
+	// Extra is the EXTRA_CONTEXT environment variable, exposed to templates
+	// as {{.Extra.key}}.
+	Extra map[string]string `json:"-"`
+}
+
+// ChannelConfig configures a notification target: a Google Chat webhook
+// (type "hangout"), Opsgenie alerts (type "opsgenie") or, when built with
+// -tags sns, an Amazon SNS topic (type "sns").
+type ChannelConfig struct {
+	Type string `json:"type"`
+	// URL is the webhook. For Opsgenie it is the API to use instead of the
+	// US region one, for SNS the topic ARN (SNS_TOPIC_ARN by default).
+	URL string `json:"url"`
+	// URLEnv names an environment variable holding the URL, to keep webhook
+	// keys out of the config file.
+	URLEnv string `json:"url_env"`
+	// Format "card" shows the commit message in a Google Chat card.
+	Format string `json:"format"`
+	// PlainText marks a hangout-compatible webhook that doesn't render
+	// markdown, so commit messages are sanitized for it (see
+	// COMMIT_MARKDOWN).
+	PlainText bool `json:"plain_text"`
+	// Timeout bounds a single delivery; it defaults to 10s.
+	Timeout Duration `json:"timeout"`
+	// Locale selects the rule's localized templates and the date format for
+	// the channel; it defaults to "en".
+	Locale string `json:"locale"`
+	// Priorities maps build statuses to Opsgenie alert priorities; statuses
+	// without one raise no alert. It defaults to FAILURE P2, TIMEOUT and
+	// INTERNAL_ERROR P3.
+	Priorities map[string]string `json:"priorities"`
+	// Critical channels must succeed for the message to be acked under
+	// ACK_POLICY=critical.
+	Critical bool `json:"critical"`
+	// SummaryMode sends build notifications as a single line, e.g.
+	// "❌ superset@dev FAILURE at step push (abc1234 by Alice)", instead of
+	// the rule's template. SUMMARY_MODE=true does the same for HANGOUT_URL.
+	SummaryMode bool `json:"summary_mode"`
+	// Template, when set, replaces the rule's template for build
+	// notifications sent to the channel, e.g. a terse one for a pager.
+	// Templates can tell the built-in messages apart with fields such as
+	// {{.RecoveredAfter}} or {{.VerifyError}}.
+	Template string `json:"template"`
+	// MaxLength lowers the longest message the channel is sent, in
+	// characters; it defaults to the provider's limit (4096 for Google Chat).
+	// Longer messages are truncated, unless OverflowThread is set.
+	MaxLength int `json:"max_length"`
+	// OverflowThread sends a message above MaxLength to a Google Chat channel
+	// as a one-line summary with the full message in threaded replies,
+	// instead of truncating it.
+	OverflowThread bool `json:"overflow_thread"`
+	// BackupURLs are endpoints of the same channel, e.g. in other regions,
+	// tried in order when URL still fails after NOTIFY_RETRIES.
+	BackupURLs []string `json:"backup_urls"`
+}
+
+func (cc ChannelConfig) url() string {
+	if cc.URLEnv != "" {
+		return os.Getenv(cc.URLEnv)
+	}
+	return cc.URL
+}
+
+// Rule matches builds by repository, branch and status. Rules are evaluated in
+// order and the first match decides the message that is sent.
+type Rule struct {
+	// RepoName "*" makes a catch-all rule for the repos no other rule names.
+	// Its Template defaults to a "unconfigured repo built" message.
+	RepoName string `json:"repo_name"`
+	// Branches the rule applies to; empty means the config DefaultBranches.
+	Branches []string `json:"branches"`
+	// AllBranches makes the rule match builds of any branch or tag, ignoring
+	// Branches, TagPatterns and DefaultBranches; Statuses and Conditions
+	// still apply. See also the config CriticalRepos.
+	AllBranches bool `json:"all_branches"`
+	// TagPatterns match the tag of builds started by a tag push, e.g. "v*".
+	// A rule with TagPatterns and no Branches only matches tags, and its
+	// Template defaults to a release message.
+	TagPatterns []string `json:"tag_patterns"`
+	// Statuses the rule applies to; empty means SUCCESS and FAILURE.
+	Statuses []string `json:"statuses"`
+	// NotifyOnStart lets the rule match builds that are QUEUED or WORKING.
+	// Non-terminal statuses are ignored otherwise, even if listed in Statuses.
+	NotifyOnStart bool `json:"notify_on_start"`
+	// Conditions on the build substitutions that must all hold.
+	Conditions []Condition `json:"conditions"`
+	// Silent rules send nothing, e.g. to explicitly ignore unconfigured repos
+	// with a catch-all rule.
+	Silent bool `json:"silent"`
+	// BuildType is exposed to templates as {{.BuildType}}.
+	BuildType string `json:"build_type"`
+	// Template is rendered with MessageData; it defaults to the config
+	// DefaultTemplate.
+	Template string `json:"template"`
+	// Templates are localized versions of Template keyed by locale, e.g.
+	// "vi". Channels whose locale has none get Template.
+	Templates map[string]string `json:"templates"`
+	// Channels to notify; empty means the "hangout" channel.
+	Channels []string `json:"channels"`
+	// ChannelStrategy "failover" tries the channels in order and stops at
+	// the first that succeeds, instead of sending to all of them
+	// ("parallel", the default).
+	ChannelStrategy string `json:"channel_strategy"`
+	// When adds channels for builds matching a condition, e.g. production
+	// failures also going to an incidents channel. See channelsFor.
+	When []ChannelCondition `json:"when"`
+	// NotifyRecovery sends RecoveryTemplate (or the built-in "Recovered"
+	// message) instead of Template for a SUCCESS that ends a failure streak.
+	NotifyRecovery   bool   `json:"notify_recovery"`
+	RecoveryTemplate string `json:"recovery_template"`
+	// ShowSlowestSteps adds the three slowest build steps to SUCCESS
+	// notifications as {{.SlowestSteps}}.
+	ShowSlowestSteps bool `json:"show_slowest_steps"`
+	// Delay holds back SUCCESS messages, e.g. to give a deployment time to
+	// roll out. Other statuses are sent right away.
+	Delay Duration `json:"delay"`
+	// Verify checks a SUCCESS deploy after the Delay with a GET of VerifyURL
+	// (or VERIFY_URL). Unless it answers 200, VerifyFailedTemplate (or the
+	// built-in "may have failed to come up" warning) is sent instead. It is
+	// opt-in; no built-in rule verifies.
+	Verify               bool   `json:"verify"`
+	VerifyURL            string `json:"verify_url"`
+	VerifyFailedTemplate string `json:"verify_failed_template"`
+	// Cooldown holds back further notifications for a trigger/branch once one
+	// has been sent, until it elapses; then a summary of how many were held
+	// back is sent. Zero disables it.
+	Cooldown Duration `json:"cooldown"`
+	// A commit changing more than LargeChangeFiles files or LargeChangeLines
+	// lines sets {{.LargeChange}} and mentions LargeChangeMention. Zero
+	// disables a threshold; without commit stats neither applies. The
+	// /commits endpoint counts at most 300 files, so a higher
+	// LargeChangeFiles needs GITHUB_COMMIT_ENDPOINT=graphql.
+	LargeChangeFiles   int    `json:"large_change_files"`
+	LargeChangeLines   int    `json:"large_change_lines"`
+	LargeChangeMention string `json:"large_change_mention"`
+	// Once a trigger/branch has failed EscalationThreshold times in a row the
+	// EscalationTemplate (or Template when unset) is rendered and
+	// EscalationMention is exposed to it as {{.Mention}}. Zero disables it.
+	EscalationThreshold int    `json:"escalation_threshold"`
+	EscalationTemplate  string `json:"escalation_template"`
+	EscalationMention   string `json:"escalation_mention"`
+	// An INTERNAL_ERROR (listed in Statuses) is a Cloud Build or
+	// infrastructure problem rather than a failure of the build itself. It
+	// gets InternalErrorTemplate (or the built-in "internal error" message)
+	// instead of Template, and goes to InternalErrorChannels and mentions
+	// InternalErrorMention when they are set. It never counts towards a
+	// failure streak or escalation.
+	InternalErrorTemplate string   `json:"internal_error_template"`
+	InternalErrorChannels []string `json:"internal_error_channels"`
+	InternalErrorMention  string   `json:"internal_error_mention"`
+	// SuppressExternal drops builds of commits by external authors (see
+	// InternalDomains); otherwise ExternalChannels, when set, replace the
+	// rule's channels for them. Templates can check {{.ExternalAuthor}}.
+	SuppressExternal bool     `json:"suppress_external"`
+	ExternalChannels []string `json:"external_channels"`
+	// QueueSLA alerts when a build waited longer than this between being
+	// created and starting, a sign the workers are saturated. The alert,
+	// QueueSLATemplate or the built-in "queued for" message, is sent when
+	// the build starts (WORKING), even without NotifyOnStart.
+	QueueSLA         Duration `json:"queue_sla"`
+	QueueSLATemplate string   `json:"queue_sla_template"`
+	// RunningAlert sends a "still running" notification, with
+	// RunningAlertTemplate or the built-in message, for builds that have
+	// been WORKING this long without reaching a terminal status. It is
+	// checked from the WORKING message, even without NotifyOnStart.
+	RunningAlert         Duration `json:"running_alert"`
+	RunningAlertTemplate string   `json:"running_alert_template"`
+	// MentionAuthor mentions the commit author, as mapped in the config
+	// ChatUsers, in failure notifications; see also OnCallMention. The
+	// large change, escalation and internal error mentions take precedence.
+	MentionAuthor bool `json:"mention_author"`
+	// FirstDeployOfDay marks the first SUCCESS of the day (in the config
+	// Timezone) for the trigger and branch with a "first deploy today"
+	// line and also sends it to FirstDeployChannels.
+	FirstDeployOfDay    bool     `json:"first_deploy_of_day"`
+	FirstDeployChannels []string `json:"first_deploy_channels"`
+	// ShowStepRetries is meant to report steps Cloud Build retried
+	// ("succeeded after N step retries"). Cloud Build status messages carry
+	// no retry counts, neither per step nor per build, so it has no effect
+	// until they do; a build retried by hand or by a trigger arrives as a
+	// separate build.
+	ShowStepRetries bool `json:"show_step_retries"`
+	// Superseded decides what happens to a CANCELLED build (listed in
+	// Statuses) once a newer build of the same trigger and branch has been
+	// seen, i.e. it was cancelled in favour of that build: "suppress" sends
+	// nothing, "info" sends a plain "superseded" message instead of
+	// Template. Empty treats it like any other cancellation.
+	Superseded string `json:"superseded"`
+	// AggregateWindow combines the notifications of the builds of a commit,
+	// e.g. the parallel triggers of a monorepo, that arrive within this
+	// window of the first into one message listing each build, failures
+	// first highlighted. Zero sends each on its own.
+	AggregateWindow Duration `json:"aggregate_window"`
+	// Digest collects the builds of a pipeline run, e.g. the repos of a
+	// nightly run, into one summary instead of a notification each.
+	Digest *Digest `json:"digest"`
+	// ShowSubstitutions appends the build's custom "_" substitutions to
+	// failure notifications, leaving out those named like a secret; see
+	// the config SecretSubstitutions.
+	ShowSubstitutions bool `json:"show_substitutions"`
+	// NoOp decides what happens to a SUCCESS build that had nothing to do,
+	// e.g. no changes to deploy: "suppress" sends nothing, "info" sends a
+	// plain "nothing to deploy" message instead of Template. A build is a
+	// no-op when it sets the substitution _NOOP=true, or when NoOpConditions
+	// are given and all hold. Empty treats it like any other success.
+	NoOp string `json:"noop"`
+	// NoOpConditions detect no-op builds from their substitutions, e.g.
+	// {"key": "_CHANGED_SERVICES", "op": "equals", "value": ""}.
+	NoOpConditions []Condition `json:"noop_conditions"`
+}
+
+// FailureCategory matches failed builds by status (any failure status when
+// empty) and failed step, as named in notifications ({{.FailureStep}}),
+// matching one of the Steps patterns as in IgnoreAuthors. Empty Steps match
+// any step.
+type FailureCategory struct {
+	Name     string   `json:"name"`
+	Statuses []string `json:"statuses"`
+	Steps    []string `json:"steps"`
+	// Runbook is a URL shown as "See runbook: ..." with the failure.
+	Runbook string `json:"runbook"`
+}
+
+// Digest groups builds by a pipeline run id read from a substitution and
+// sends one summary per run, e.g. "Nightly complete: 8 succeeded, 2 failed
+// (repoA, repoB)", once Expected builds reported or Timeout elapsed after
+// the first. Builds without the substitution are notified on their own.
+type Digest struct {
+	// Substitution holds the run id, e.g. "_PIPELINE_ID".
+	Substitution string `json:"substitution"`
+	// Name is shown in the summary; it defaults to the run id.
+	Name string `json:"name"`
+	// Expected is the number of builds in a run. Zero waits for Timeout.
+	Expected int `json:"expected"`
+	// Timeout bounds the wait for the builds of a run; it defaults to an
+	// hour. Builds that did not report by then are counted as missing.
+	Timeout Duration `json:"timeout"`
+	// Template replaces the built-in summary. It can range over
+	// {{.Builds}}, {{.SucceededBuilds}} and {{.FailedBuilds}}.
+	Template string `json:"template"`
+}
+
+func (d *Digest) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return time.Hour
+	}
+	return time.Duration(d.Timeout)
+}
+
+func (fc *FailureCategory) matches(info *CloudBuildInfo, step string) bool {
+	statuses := fc.Statuses
+	if len(statuses) == 0 {
+		statuses = failureStatuses
+	}
+	if !contains(statuses, info.Status) {
+		return false
+	}
+	if len(fc.Steps) == 0 {
+		return true
+	}
+	for _, pattern := range fc.Steps {
+		if step != "" && globMatch(pattern, step) {
+			return true
+		}
+	}
+	return false
+}
+
+// failureCategory returns the category of a failed build, or nil.
+func (c *Config) failureCategory(info *CloudBuildInfo, step string) *FailureCategory {
+	for i := range c.FailureCategories {
+		if c.FailureCategories[i].matches(info, step) {
+			return &c.FailureCategories[i]
+		}
+	}
+	return nil
+}
+
+// Condition compares a build substitution such as "_ENV" with Value. Op is
+// one of "equals", "notEquals" or "matches" (a regular expression).
+type Condition struct {
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+func (c *Condition) compile() error {
+	switch c.Op {
+	case "equals", "notEquals":
+		return nil
+	case "matches":
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return err
+		}
+		c.re = re
+		return nil
+	}
+	return fmt.Errorf("unknown op %q", c.Op)
+}
+
+func (c *Condition) holds(subs Substitutions) bool {
+	value := subs.Get(c.Key)
+	switch c.Op {
+	case "equals":
+		return value == c.Value
+	case "notEquals":
+		return value != c.Value
+	case "matches":
+		return c.re != nil && c.re.MatchString(value)
+	}
+	return false
+}
+
+// ChannelCondition adds Channels when the build matches every non-empty
+// list of statuses, branches and build types.
+type ChannelCondition struct {
+	Statuses   []string `json:"statuses"`
+	Branches   []string `json:"branches"`
+	BuildTypes []string `json:"build_types"`
+	Channels   []string `json:"channels"`
+}
+
+func (cc *ChannelCondition) matches(info *CloudBuildInfo, buildType string) bool {
+	return (len(cc.Statuses) == 0 || contains(cc.Statuses, info.Status)) &&
+		(len(cc.Branches) == 0 || contains(cc.Branches, info.Substitutions.BRANCHNAME)) &&
+		(len(cc.BuildTypes) == 0 || contains(cc.BuildTypes, buildType))
+}
+
+// Duration is a time.Duration that is written as "6m" or "30s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var defaultBranches = []string{"dev", "master"}
+
+func defaultConfig() *Config {
+	return &Config{
+		DefaultBranches: defaultBranches,
+		Rules: []Rule{
+			{
+				RepoName: "superset",
+				Statuses: []string{"SUCCESS"},
+				Template: supersetSuccessTemplate,
+				Delay:    Duration(6 * time.Minute),
+			},
+			{
+				RepoName: "superset",
+				Statuses: []string{"FAILURE"},
+				Template: supersetFailureTemplate,
+			},
+			{
+				RepoName:   "ProjectStrand",
+				Statuses:   []string{"FAILURE"},
+				Conditions: []Condition{{Key: "_NAMESPACE", Op: "equals", Value: "test"}},
+				BuildType:  "unit-testing",
+				Template:   projectStrandFailureTemplate,
+			},
+			{
+				RepoName:  "ProjectStrand",
+				Branches:  []string{"dev"},
+				Statuses:  []string{"FAILURE"},
+				BuildType: "nightly",
+				Template:  projectStrandFailureTemplate,
+			},
+			{
+				RepoName:  "ProjectStrand",
+				Branches:  []string{"master"},
+				Statuses:  []string{"FAILURE"},
+				BuildType: "production",
+				Template:  projectStrandFailureTemplate,
+			},
+		},
+	}
+}
+
+// LoadConfig reads the JSON in APP_CONFIG or the file named by CONFIG_FILE,
+// falling back to the built-in
+// rules when the variable is empty.
+func LoadConfig() (*Config, error) {
+	data := os.Getenv("APP_CONFIG")
+	if data == "" {
+		return LoadConfigFile(os.Getenv("CONFIG_FILE"))
+	}
+	if os.Getenv("CONFIG_FILE") != "" {
+		return nil, fmt.Errorf("%w: set only one of APP_CONFIG and CONFIG_FILE", ErrConfig)
+	}
+	cfg, err := parseConfig([]byte(data), "APP_CONFIG")
+	if err != nil {
+		return nil, err
+	}
+	return withExtraContext(cfg)
+}
+
+// LoadConfigFile reads the config at path, or returns the built-in rules
+// when path is empty.
+func LoadConfigFile(path string) (*Config, error) {
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return withExtraContext(cfg)
+}
+
+// withExtraContext adds the EXTRA_CONTEXT values to a loaded config.
+func withExtraContext(cfg *Config) (*Config, error) {
+	var err error
+	if cfg.Extra, err = parseExtraContext(os.Getenv("EXTRA_CONTEXT")); err != nil {
+		return nil, fmt.Errorf("%w: EXTRA_CONTEXT: %v", ErrConfig, err)
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string) (*Config, error) {
+	if path == "" {
+		cfg := defaultConfig()
+		return cfg, cfg.Validate()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	return parseConfig(data, path)
+}
+
+// parseConfig decodes and validates a JSON config; source names it in
+// errors.
+func parseConfig(data []byte, source string) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: parse %s: %v", ErrConfig, source, err)
+	}
+	if len(cfg.DefaultBranches) == 0 {
+		cfg.DefaultBranches = defaultBranches
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrConfig, source, err)
+	}
+	return &cfg, nil
+}
+
+// parseExtraContext parses "cluster=eu-1,region=europe-west1".
+func parseExtraContext(value string) (map[string]string, error) {
+	extra := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return extra, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		if _, dup := extra[key]; dup {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		extra[key] = strings.TrimSpace(kv[1])
+	}
+	return extra, nil
+}
+
+// Validate checks that every rule can be matched, rendered and delivered,
+// and compiles the rule conditions.
+func (c *Config) Validate() error {
+	switch c.CommitIdentity {
+	case "", identityAuthor, identityCommitter, identityBoth:
+	default:
+		return fmt.Errorf("commit_identity: expected author, committer or both, got %q", c.CommitIdentity)
+	}
+	if c.QuietHours != nil {
+		if err := c.QuietHours.compile(); err != nil {
+			return fmt.Errorf("quiet_hours: %v", err)
+		}
+	}
+	if _, err := parseTemplate(c.CommitURLTemplate); err != nil {
+		return fmt.Errorf("commit_url_template: %v", err)
+	}
+	if len(c.SecretSubstitutions) == 0 {
+		c.SecretSubstitutions = defaultSecretSubstitutions
+	}
+	if c.DefaultTemplate == "" {
+		c.DefaultTemplate = defaultTemplate
+	}
+	if _, err := parseTemplate(c.DefaultTemplate); err != nil {
+		return fmt.Errorf("default_template: %v", err)
+	}
+	for i, fc := range c.FailureCategories {
+		if fc.Name == "" {
+			return fmt.Errorf("failure category %d: name is required", i)
+		}
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("timezone: %v", err)
+	}
+	if c.Timezone == "" {
+		loc = time.Local
+	}
+	c.loc = loc
+	for _, sources := range [][]string{c.RepoSources, c.BranchSources, c.CommitSources} {
+		for _, source := range sources {
+			if err := checkSource(source); err != nil {
+				return err
+			}
+		}
+	}
+	for name, cc := range c.Channels {
+		if _, ok := notifierTypes[cc.Type]; !ok && cc.Type != "hangout" && cc.Type != "opsgenie" {
+			if cc.Type == "sns" {
+				return fmt.Errorf("channel %s: sns support is not built in, build with -tags sns", name)
+			}
+			return fmt.Errorf("channel %s: unknown type %q", name, cc.Type)
+		}
+		if _, err := parseTemplate(cc.Template); err != nil {
+			return fmt.Errorf("channel %s: %v", name, err)
+		}
+		if cc.MaxLength < 0 {
+			return fmt.Errorf("channel %s: max_length must not be negative", name)
+		}
+		if cc.OverflowThread && cc.Type != "hangout" {
+			return fmt.Errorf("channel %s: overflow_thread needs a hangout channel", name)
+		}
+	}
+	for name := range c.HangoutURLs {
+		if _, ok := c.Channels[name]; ok {
+			return fmt.Errorf("hangout url %s: also defined in channels", name)
+		}
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.RepoName == "" {
+			return fmt.Errorf("rule %d: repo_name is required", i)
+		}
+		if rule.Template == "" && rule.RepoName == catchAllRepo {
+			rule.Template = unconfiguredRepoTemplate
+		}
+		if rule.Template == "" && len(rule.TagPatterns) > 0 {
+			rule.Template = releaseTemplate
+		}
+		if rule.Template == "" && !rule.Silent {
+			rule.Template = c.DefaultTemplate
+		}
+		switch rule.Superseded {
+		case "", supersededSuppress, supersededInfo:
+		default:
+			return fmt.Errorf("rule %d: superseded must be %q or %q", i, supersededSuppress, supersededInfo)
+		}
+		switch rule.NoOp {
+		case "", noOpSuppress, noOpInfo:
+		default:
+			return fmt.Errorf("rule %d: noop must be %q or %q", i, noOpSuppress, noOpInfo)
+		}
+		switch rule.ChannelStrategy {
+		case "", strategyParallel, strategyFailover:
+		default:
+			return fmt.Errorf("rule %d: channel_strategy must be %q or %q", i, strategyParallel, strategyFailover)
+		}
+		names := append(append(append([]string{}, rule.Channels...), rule.InternalErrorChannels...), rule.ExternalChannels...)
+		names = append(names, rule.FirstDeployChannels...)
+		for _, when := range rule.When {
+			names = append(names, when.Channels...)
+		}
+		for _, name := range names {
+			if !c.hasChannel(name) {
+				return fmt.Errorf("rule %d: unknown channel %q", i, name)
+			}
+		}
+		for j := range rule.Conditions {
+			if err := rule.Conditions[j].compile(); err != nil {
+				return fmt.Errorf("rule %d condition %d: %v", i, j, err)
+			}
+		}
+		if d := rule.Digest; d != nil {
+			if d.Substitution == "" {
+				return fmt.Errorf("rule %d: digest substitution is required", i)
+			}
+			if d.Expected < 0 {
+				return fmt.Errorf("rule %d: digest expected must not be negative", i)
+			}
+			if _, err := parseTemplate(d.Template); err != nil {
+				return fmt.Errorf("rule %d: digest: %v", i, err)
+			}
+		}
+		for j := range rule.NoOpConditions {
+			if err := rule.NoOpConditions[j].compile(); err != nil {
+				return fmt.Errorf("rule %d noop condition %d: %v", i, j, err)
+			}
+		}
+		for _, text := range []string{rule.Template, rule.EscalationTemplate, rule.RecoveryTemplate, rule.VerifyFailedTemplate, rule.InternalErrorTemplate, rule.QueueSLATemplate, rule.RunningAlertTemplate} {
+			if _, err := parseTemplate(text); err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		for locale, text := range rule.Templates {
+			if _, err := parseTemplate(text); err != nil {
+				return fmt.Errorf("rule %d template %q: %v", i, locale, err)
+			}
+		}
+	}
+	return nil
+}
+
+// commitURL renders CommitURLTemplate for a build.
+func (c *Config) commitURL(info *CloudBuildInfo) (string, error) {
+	tmpl, err := parseTemplate(c.CommitURLTemplate)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, struct{ Repo, Branch, Sha string }{
+		info.Substitutions.REPONAME, info.Substitutions.BRANCHNAME, info.Substitutions.COMMITSHA,
+	})
+	return b.String(), err
+}
+
+// longestDelay is the longest Delay of any rule.
+func (c *Config) longestDelay() time.Duration {
+	var longest time.Duration
+	for i := range c.Rules {
+		if d := time.Duration(c.Rules[i].Delay); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// otherLabel replaces metric label values the config does not name.
+const otherLabel = "other"
+
+// metricLabels returns the repo and branch of a build as metric labels. Only
+// repos and branches named by a rule (or the default branches) are kept,
+// which bounds the number of series; the rest become "other".
+func (c *Config) metricLabels(info *CloudBuildInfo) (repo, branch string) {
+	repo, branch = otherLabel, otherLabel
+	if c.configuresRepo(info.Substitutions.REPONAME) {
+		repo = info.Substitutions.REPONAME
+	}
+	if contains(c.DefaultBranches, info.Substitutions.BRANCHNAME) {
+		branch = info.Substitutions.BRANCHNAME
+	}
+	for i := range c.Rules {
+		if contains(c.Rules[i].Branches, info.Substitutions.BRANCHNAME) {
+			branch = info.Substitutions.BRANCHNAME
+		}
+	}
+	return repo, branch
+}
+
+// hasChannel reports whether rules can send to the channel name.
+func (c *Config) hasChannel(name string) bool {
+	_, ok := c.Channels[name]
+	_, hangout := c.HangoutURLs[name]
+	return ok || hangout || name == legacyChannel
+}
+
+// wantsStatus reports whether any rule can match a build with status, so
+// other messages can be dropped without decoding them.
+func (c *Config) wantsStatus(status string) bool {
+	for i := range c.Rules {
+		if c.Rules[i].matchesStatus(status) {
+			return true
+		}
+	}
+	// The superseding build is usually still queued when the old one is
+	// cancelled.
+	if status == "QUEUED" && c.tracksSuperseded() {
+		return true
+	}
+	// Terminal statuses still feed the failure streaks.
+	return !contains(nonTerminalStatuses, status)
+}
+
+// tracksSuperseded reports whether any rule handles superseded builds.
+func (c *Config) tracksSuperseded() bool {
+	for i := range c.Rules {
+		if c.Rules[i].Superseded != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of CommitIdentity.
+const (
+	identityAuthor    = "author"
+	identityCommitter = "committer"
+	identityBoth      = "both"
+)
+
+// Values of Rule.Superseded.
+const (
+	supersededSuppress = "suppress"
+	supersededInfo     = "info"
+)
+
+// Values of Rule.NoOp.
+const (
+	noOpSuppress = "suppress"
+	noOpInfo     = "info"
+)
+
+var defaultSecretSubstitutions = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*", "*KEY*"}
+
+// customSubstitutions lists the build's "_" substitutions as "_ENV=prod",
+// sorted by name, leaving out those matching SecretSubstitutions.
+func (c *Config) customSubstitutions(subs Substitutions) string {
+	var names []string
+	for name := range subs.All {
+		if !strings.HasPrefix(name, "_") {
+			continue
+		}
+		secret := false
+		for _, pattern := range c.SecretSubstitutions {
+			if globMatch(pattern, name) {
+				secret = true
+				break
+			}
+		}
+		if !secret {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + "=" + subs.All[name]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// catchAllRepo is the RepoName of catch-all rules.
+const catchAllRepo = "*"
+
+// Match returns the first rule that applies to the build, or nil. Catch-all
+// rules are only considered for repos that no other rule names, whatever
+// their position in the list.
+func (c *Config) Match(info *CloudBuildInfo) *Rule {
+	repo := info.Substitutions.REPONAME
+	if c.configuresRepo(repo) {
+		return c.match(info, repo)
+	}
+	return c.match(info, catchAllRepo)
+}
+
+// configuresRepo reports whether a rule other than a catch-all names repo.
+func (c *Config) configuresRepo(repo string) bool {
+	for i := range c.Rules {
+		if c.Rules[i].RepoName == repo && repo != catchAllRepo {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first rule for repoName that applies to the build.
+func (c *Config) match(info *CloudBuildInfo, repoName string) *Rule {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.RepoName != repoName {
+			continue
+		}
+		allBranches := rule.AllBranches || contains(c.CriticalRepos, info.Substitutions.REPONAME)
+		if (!allBranches && !rule.matchesRef(info, c.DefaultBranches)) || !rule.matchesStatus(info.Status) {
+			continue
+		}
+		if !rule.conditionsHold(info.Substitutions) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// nonTerminalStatuses are reported while a build is still in progress.
+var nonTerminalStatuses = []string{"STATUS_UNKNOWN", "PENDING", "QUEUED", "WORKING"}
+
+// matchesRef reports whether the rule applies to the branch or, for builds
+// of a tag push, the tag of the build. Rules with TagPatterns and no Branches
+// only match tags.
+func (r *Rule) matchesRef(info *CloudBuildInfo, defaultBranches []string) bool {
+	if tag := info.Substitutions.TAGNAME; tag != "" && info.Substitutions.BRANCHNAME == "" {
+		for _, pattern := range r.TagPatterns {
+			if globMatch(pattern, tag) {
+				return true
+			}
+		}
+		return false
+	}
+	branches := r.Branches
+	if len(branches) == 0 {
+		if len(r.TagPatterns) > 0 {
+			return false
+		}
+		branches = defaultBranches
+	}
+	return contains(branches, info.Substitutions.BRANCHNAME)
+}
+
+// largeChange reports whether a commit exceeds the rule's thresholds.
+func (r *Rule) largeChange(files, lines int) bool {
+	return (r.LargeChangeFiles > 0 && files > r.LargeChangeFiles) ||
+		(r.LargeChangeLines > 0 && lines > r.LargeChangeLines)
+}
+
+func (r *Rule) matchesStatus(status string) bool {
+	if contains(nonTerminalStatuses, status) {
+		return r.NotifyOnStart || (status == "WORKING" && (r.QueueSLA > 0 || r.RunningAlert > 0))
+	}
+	if len(r.Statuses) == 0 {
+		return status == "SUCCESS" || status == "FAILURE"
+	}
+	return contains(r.Statuses, status)
+}
+
+// channelsFor returns the channels to notify about a build: the rule's base
+// channels (or "hangout" when it has none) followed by the channels of every
+// matching When condition, in order. A channel listed more than once is only
+// notified once.
+func (r *Rule) channelsFor(info *CloudBuildInfo) []string {
+	base := r.Channels
+	if len(base) == 0 {
+		base = []string{legacyChannel}
+	}
+	var names []string
+	add := func(list []string) {
+		for _, name := range list {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	add(base)
+	for i := range r.When {
+		if r.When[i].matches(info, r.BuildType) {
+			add(r.When[i].Channels)
+		}
+	}
+	return names
+}
+
+func (r *Rule) conditionsHold(subs Substitutions) bool {
+	for i := range r.Conditions {
+		if !r.Conditions[i].holds(subs) {
+			return false
+		}
+	}
+	return true
+}
+
+// noOp reports whether a successful build had nothing to do; see NoOp.
+func (r *Rule) noOp(subs Substitutions) bool {
+	if subs.Get("_NOOP") == "true" {
+		return true
+	}
+	if len(r.NoOpConditions) == 0 {
+		return false
+	}
+	for i := range r.NoOpConditions {
+		if !r.NoOpConditions[i].holds(subs) {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoresAuthor reports whether the commit author matches IgnoreAuthors.
+func (c *Config) ignoresAuthor(author PersonInfo) bool {
+	for _, pattern := range c.IgnoreAuthors {
+		if globMatch(pattern, author.Name) || globMatch(pattern, author.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalAuthor reports whether a commit's author is outside the
+// organization. Commits whose author is unknown, e.g. when the GitHub lookup
+// failed, are not.
+func (c *Config) externalAuthor(commit GithubInfo) bool {
+	if len(c.InternalDomains) == 0 && len(c.InternalLogins) == 0 {
+		return false
+	}
+	email, login := commit.Author.Email, commit.AuthorLogin
+	if email == "" && login == "" {
+		return false
+	}
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		domain := email[at+1:]
+		for _, internal := range c.InternalDomains {
+			if strings.EqualFold(domain, internal) {
+				return false
+			}
+		}
+	}
+	for _, pattern := range c.InternalLogins {
+		if login != "" && globMatch(pattern, login) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorMention is the chat mention of the person the commit is attributed
+// to (the committer when CommitIdentity is "committer"), looked up in
+// ChatUsers by email and then GitHub login, or OnCallMention.
+func (c *Config) authorMention(commit GithubInfo) string {
+	email, login := commit.Author.Email, commit.AuthorLogin
+	if c.CommitIdentity == identityCommitter {
+		email, login = commit.Committer.Email, commit.CommitterLogin
+	}
+	for _, key := range []string{email, login} {
+		if key == "" {
+			continue
+		}
+		for user, id := range c.ChatUsers {
+			if strings.EqualFold(user, key) {
+				return chatMention(id)
+			}
+		}
+	}
+	return c.OnCallMention
+}
+
+// chatMention formats a Google Chat user id as a mention.
+func chatMention(id string) string {
+	if strings.HasPrefix(id, "users/") {
+		return "<" + id + ">"
+	}
+	return id
+}
+
+// globMatch reports whether s matches pattern, ignoring case. "*" matches
+// any run of characters and everything else matches itself; unlike
+// path.Match, brackets are literal so "*[bot]*" matches "renovate[bot]".
+func globMatch(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
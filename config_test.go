@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testConfig decodes and validates a JSON config.
+func testConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	var config Config
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+// testBuild decodes a build of repo on main with the given status and
+// substitutions.
+func testBuild(t *testing.T, repo, status string, subs map[string]string) *CloudBuildInfo {
+	t.Helper()
+	all := map[string]string{"REPO_NAME": repo, "BRANCH_NAME": "main"}
+	for k, v := range subs {
+		all[k] = v
+	}
+	data, err := json.Marshal(map[string]interface{}{"id": "build-1", "status": status, "substitutions": all})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info CloudBuildInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	return &info
+}
+
+func TestMatchConditions(t *testing.T) {
+	config := testConfig(t, `{"rules": [
+		{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS"], "template": "prod-eu", "conditions": [
+			{"key": "_ENV", "op": "equals", "value": "prod"},
+			{"key": "_REGION", "op": "matches", "value": "^eu-"}
+		]},
+		{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS"], "template": "prod", "conditions": [
+			{"key": "_ENV", "op": "equals", "value": "prod"},
+			{"key": "_DRY_RUN", "op": "notEquals", "value": "true"}
+		]},
+		{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS"], "template": "default"}
+	]}`)
+	tests := []struct {
+		subs map[string]string
+		want string
+	}{
+		{map[string]string{"_ENV": "prod", "_REGION": "eu-west1"}, "prod-eu"},
+		{map[string]string{"_ENV": "prod", "_REGION": "eu-west1", "_DRY_RUN": "true"}, "prod-eu"},
+		{map[string]string{"_ENV": "prod", "_REGION": "us-east1"}, "prod"},
+		{map[string]string{"_ENV": "prod", "_REGION": "us-east1", "_DRY_RUN": "true"}, "default"},
+		{map[string]string{"_ENV": "prod"}, "prod"},
+		{map[string]string{"_ENV": "staging", "_REGION": "eu-west1"}, "default"},
+		{map[string]string{"_REGION": "eu-west1"}, "default"},
+	}
+	for _, tt := range tests {
+		rule := config.Match(testBuild(t, "api", "SUCCESS", tt.subs))
+		if rule == nil {
+			t.Errorf("Match(%v) = nil, want %s", tt.subs, tt.want)
+			continue
+		}
+		if rule.Template != tt.want {
+			t.Errorf("Match(%v) = %s, want %s", tt.subs, rule.Template, tt.want)
+		}
+	}
+}
+
+func TestMatchCatchAll(t *testing.T) {
+	config := testConfig(t, `{"rules": [
+		{"repo_name": "api", "branches": ["main"], "statuses": ["FAILURE"], "template": "api"},
+		{"repo_name": "*", "branches": ["main"], "statuses": ["SUCCESS", "FAILURE"], "template": "catch-all"},
+		{"repo_name": "web", "branches": ["main"], "statuses": ["SUCCESS", "FAILURE"], "template": "web"}
+	]}`)
+	tests := []struct {
+		repo, status string
+		want         string
+	}{
+		{"api", "FAILURE", "api"},
+		// api has a rule, so the catch-all doesn't pick up what it leaves out.
+		{"api", "SUCCESS", ""},
+		// A specific rule after the catch-all still wins.
+		{"web", "SUCCESS", "web"},
+		{"billing", "SUCCESS", "catch-all"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := config.Match(testBuild(t, tt.repo, tt.status, nil)); rule != nil {
+			got = rule.Template
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s %s) = %q, want %q", tt.repo, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultConfigDoesNotVerify(t *testing.T) {
+	for i, rule := range defaultConfig().Rules {
+		if rule.Verify {
+			t.Errorf("built-in rule %d (%s) verifies deploys, want it opt-in", i, rule.RepoName)
+		}
+	}
+}
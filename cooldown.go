@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// cooldownTracker rate-limits notifications per trigger and branch. Unlike
+// the dedup cache it holds back distinct builds, so a crash-looping trigger
+// cannot flood a channel.
+type cooldownTracker struct {
+	mu      sync.Mutex
+	clock   Clock
+	windows map[string]*cooldownWindow
+	// shared are the windows in the store this replica opened and sends
+	// the summary of.
+	shared map[string]*cooldownWindow
+	// store, when set, keeps the cooldowns for every replica.
+	store cooldownStore
+}
+
+// cooldownStore shares cooldown windows between replicas. start opens a
+// window for key unless one is open, hold counts a notification held back
+// by the open window, and end closes the window and returns what it held.
+type cooldownStore interface {
+	start(key string, d time.Duration) (bool, error)
+	hold(key string, d time.Duration, data MessageData, channels []string) error
+	end(key string) (*cooldownWindow, error)
+}
+
+// cooldownWindow is an active cooldown and the notifications it held back.
+type cooldownWindow struct {
+	suppressed int
+	// last is the most recent suppressed notification, which the summary is
+	// rendered from.
+	last     MessageData
+	channels []string
+	summary  func(w *cooldownWindow)
+}
+
+func newCooldownTracker(clock Clock) *cooldownTracker {
+	return &cooldownTracker{clock: clock, windows: make(map[string]*cooldownWindow), shared: make(map[string]*cooldownWindow)}
+}
+
+// allow reports whether a notification for key may be sent. The first one
+// starts a cooldown of d during which the others are counted instead; when
+// it ends, summary is called with the last of them if there were any.
+func (t *cooldownTracker) allow(key string, d time.Duration, channels []string, data MessageData, summary func(w *cooldownWindow)) bool {
+	if t.store != nil {
+		allowed, err := t.allowShared(key, d, channels, data, summary)
+		if err == nil {
+			return allowed
+		}
+		log.Printf("Could not check the shared cooldown of %s, using the local one: %v", key, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w, ok := t.windows[key]; ok {
+		w.suppressed++
+		w.last = data
+		w.channels = channels
+		return false
+	}
+	w := &cooldownWindow{summary: summary}
+	t.windows[key] = w
+	t.clock.AfterFunc(d, func() {
+		if t.take(t.windows, key, w) && w.suppressed > 0 {
+			summary(w)
+		}
+	})
+	return true
+}
+
+// take removes w from windows, unless it was already ended.
+func (t *cooldownTracker) take(windows map[string]*cooldownWindow, key string, w *cooldownWindow) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if windows[key] != w {
+		return false
+	}
+	delete(windows, key)
+	return true
+}
+
+// allowShared is allow with the window in the store. The replica that opens
+// a window sends its summary.
+func (t *cooldownTracker) allowShared(key string, d time.Duration, channels []string, data MessageData, summary func(w *cooldownWindow)) (bool, error) {
+	started, err := t.store.start(key, d)
+	if err != nil {
+		return false, err
+	}
+	if !started {
+		if err := t.store.hold(key, d, data, channels); err != nil {
+			log.Printf("Could not count a held back notification of %s in the shared state: %v", key, err)
+		}
+		return false, nil
+	}
+	opened := &cooldownWindow{summary: summary}
+	t.mu.Lock()
+	t.shared[key] = opened
+	t.mu.Unlock()
+	t.clock.AfterFunc(d, func() {
+		if t.take(t.shared, key, opened) {
+			t.endShared(key, summary)
+		}
+	})
+	return true, nil
+}
+
+func (t *cooldownTracker) endShared(key string, summary func(w *cooldownWindow)) {
+	w, err := t.store.end(key)
+	if err != nil {
+		log.Printf("Could not end the shared cooldown of %s: %v", key, err)
+		return
+	}
+	if w.suppressed > 0 {
+		summary(w)
+	}
+}
+
+// endAll ends every open window before its time, e.g. on shutdown, and
+// returns the calls that send their summaries.
+func (t *cooldownTracker) endAll() []func() {
+	t.mu.Lock()
+	windows, shared := t.windows, t.shared
+	t.windows, t.shared = make(map[string]*cooldownWindow), make(map[string]*cooldownWindow)
+	t.mu.Unlock()
+	var sends []func()
+	for _, w := range windows {
+		if w.suppressed > 0 {
+			w := w
+			sends = append(sends, func() { w.summary(w) })
+		}
+	}
+	for key, w := range shared {
+		key, w := key, w
+		sends = append(sends, func() { t.endShared(key, w.summary) })
+	}
+	return sends
+}
+
+// sendCooldownSummary tells the rule's channels how many notifications a
+// cooldown held back.
+func (p *Processor) sendCooldownSummary(w *cooldownWindow) {
+	data := w.last
+	data.Suppressed = w.suppressed
+	if _, err := p.dispatch(context.Background(), w.channels, cooldownSummaryTemplate, nil, data); err != nil {
+		log.Printf("Could not send the cooldown summary for %s on %s: %v", data.Repo, data.Branch, err)
+	}
+}
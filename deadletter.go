@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// DeadLetter receives messages that could not be processed after
+// MAX_PROCESSING_ATTEMPTS deliveries, so operators can see poison messages.
+type DeadLetter interface {
+	Forward(ctx context.Context, msg *pubsub.Message, attempts int, cause error) error
+}
+
+// newDeadLetter returns the dead letter destination configured with
+// DEADLETTER_TOPIC (a pubsub topic) or DEADLETTER_CHANNEL (a notifier
+// channel), or nil when neither is set.
+func newDeadLetter(client *pubsub.Client, channels map[string]*channel) (DeadLetter, error) {
+	if topic := os.Getenv("DEADLETTER_TOPIC"); topic != "" {
+		return &topicDeadLetter{topic: client.Topic(topic)}, nil
+	}
+	if name := os.Getenv("DEADLETTER_CHANNEL"); name != "" {
+		ch, ok := channels[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown DEADLETTER_CHANNEL %q", ErrConfig, name)
+		}
+		return &channelDeadLetter{ch: ch}, nil
+	}
+	return nil, nil
+}
+
+// topicDeadLetter republishes the raw message with the error in attributes.
+type topicDeadLetter struct {
+	topic *pubsub.Topic
+}
+
+func (d *topicDeadLetter) Forward(ctx context.Context, msg *pubsub.Message, attempts int, cause error) error {
+	attrs := map[string]string{
+		"originalMessageId": msg.ID,
+		"attempts":          fmt.Sprint(attempts),
+		"error":             cause.Error(),
+	}
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	_, err := d.topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs}).Get(ctx)
+	return err
+}
+
+// channelDeadLetter posts the raw message and the error to a chat channel.
+type channelDeadLetter struct {
+	ch *channel
+}
+
+const maxDeadLetterPayload = 2000
+
+func (d *channelDeadLetter) Forward(ctx context.Context, msg *pubsub.Message, attempts int, cause error) error {
+	data := string(msg.Data)
+	if len(data) > maxDeadLetterPayload {
+		data = data[:maxDeadLetterPayload] + "…"
+	}
+	message := fmt.Sprintf("Gave up on pubsub message %s after %d attempts: %v ```%s```", msg.ID, attempts, cause, data)
+	ctx, cancel := context.WithTimeout(ctx, d.ch.timeout)
+	defer cancel()
+	return d.ch.notifier.Notify(ctx, message, MessageData{})
+}
+
+// deliveryAttempt returns the delivery count of msg. Pubsub only reports
+// DeliveryAttempt when the subscription has a dead letter policy, so it falls
+// back to counting the deliveries seen by this process.
+func deliveryAttempt(deliveries *attemptCounter, msg *pubsub.Message) int {
+	n := deliveries.next(msg.ID)
+	if msg.DeliveryAttempt != nil {
+		return *msg.DeliveryAttempt
+	}
+	return n
+}
+
+// permanent reports whether processing err will fail the same way on every
+// redelivery, so the message should be dead-lettered straight away.
+func permanent(err error) bool {
+	return errors.Is(err, ErrInvalidPayload) || errors.Is(err, ErrConfig)
+}
+
+// handleFailure decides what happens to a message whose processing failed:
+// it is redelivered until maxAttempts deliveries, then forwarded to the dead
+// letter destination and acked. It reports whether the message is to be
+// acked.
+func handleFailure(ctx context.Context, msg *pubsub.Message, err error, attempts, maxAttempts int, deadLetter DeadLetter) bool {
+	if attempts < maxAttempts && !permanent(err) {
+		log.Printf("Got %s err on attempt %d/%d, redelivering: %s\n", errorCategory(err), attempts, maxAttempts, err)
+		return false
+	}
+	log.Printf("Giving up on message %s after %d attempts: %s\n", msg.ID, attempts, err)
+	if deadLetter != nil {
+		if ferr := deadLetter.Forward(ctx, msg, attempts, err); ferr != nil {
+			log.Printf("Could not forward message %s to dead letter: %v", msg.ID, ferr)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers recently processed builds so redelivered or
+// duplicated messages don't notify twice. It also tracks the builds being
+// processed, so a message redelivered while the first delivery is still
+// waiting out a delay is not processed a second time.
+type dedupCache struct {
+	mu       sync.Mutex
+	clock    Clock
+	ttl      time.Duration
+	seen     map[string]time.Time
+	inflight map[string]bool
+	// store, when set, keeps the processed builds across restarts.
+	store dedupStore
+}
+
+func newDedupCache(clock Clock, ttl time.Duration) *dedupCache {
+	return &dedupCache{clock: clock, ttl: ttl, seen: make(map[string]time.Time), inflight: make(map[string]bool)}
+}
+
+func dedupKey(buildID, status string) string {
+	return buildID + "/" + status
+}
+
+// Seen reports whether key was marked within the TTL.
+func (c *dedupCache) Seen(key string) bool {
+	c.mu.Lock()
+	at, ok := c.seen[key]
+	c.mu.Unlock()
+	if ok && c.clock.Now().Sub(at) < c.ttl {
+		return true
+	}
+	return c.storeSeen(key)
+}
+
+// storeSeen asks the store about key. A store that can't be reached is
+// logged and treated as not having seen it, so notifications still go out.
+func (c *dedupCache) storeSeen(key string) bool {
+	if c.store == nil {
+		return false
+	}
+	seen, err := c.store.seen(key)
+	if err != nil {
+		log.Printf("Could not check the dedup store for %s: %v", key, err)
+	}
+	return seen
+}
+
+// errClaimedElsewhere is returned by Claim when another replica holds the
+// claim of a build.
+var errClaimedElsewhere = errors.New("build is claimed by another replica")
+
+// Claim marks key as being processed. It reports false when key is already
+// in flight or, unless force is set, was processed within the TTL, by any
+// replica when there is a store. With a store, the claim holds for every
+// replica for up to DEDUP_CLAIM_TTL (10m); while another replica holds it
+// Claim returns errClaimedElsewhere, so the message is redelivered rather
+// than acked and a replica that crashed while processing it only delays the
+// notification.
+func (c *dedupCache) Claim(key string, force bool) (bool, error) {
+	c.mu.Lock()
+	if c.inflight[key] {
+		c.mu.Unlock()
+		return false, nil
+	}
+	if at, ok := c.seen[key]; ok && !force && c.clock.Now().Sub(at) < c.ttl {
+		c.mu.Unlock()
+		return false, nil
+	}
+	c.inflight[key] = true
+	c.mu.Unlock()
+	if !force && c.store != nil {
+		claimed, err := c.store.claim(key, getEnvDuration("DEDUP_CLAIM_TTL", 10*time.Minute))
+		if err != nil {
+			log.Printf("Could not claim %s in the dedup store: %v", key, err)
+		} else if !claimed {
+			// The key holds either another replica's claim or the mark of a
+			// build processed since Seen was checked; only the first is
+			// worth a redelivery.
+			processed := c.storeSeen(key)
+			c.mu.Lock()
+			delete(c.inflight, key)
+			if processed {
+				c.seen[key] = c.clock.Now()
+			}
+			c.mu.Unlock()
+			if processed {
+				return false, nil
+			}
+			return false, errClaimedElsewhere
+		}
+	}
+	return true, nil
+}
+
+// Release ends the processing of a claimed key, marking it as processed when
+// it succeeded.
+func (c *dedupCache) Release(key string, processed bool) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	if processed {
+		c.Mark(key)
+	} else if c.store != nil {
+		if err := c.store.release(key); err != nil {
+			log.Printf("Could not release %s in the dedup store: %v", key, err)
+		}
+	}
+}
+
+// Mark records key as processed, in the store too, and drops expired
+// entries.
+func (c *dedupCache) Mark(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	for k, at := range c.seen {
+		if now.Sub(at) >= c.ttl {
+			delete(c.seen, k)
+		}
+	}
+	c.seen[key] = now
+	if c.store != nil {
+		if err := c.store.mark(key, c.ttl); err != nil {
+			log.Printf("Could not record %s in the dedup store: %v", key, err)
+		}
+	}
+}
+
+// dedupStore persists the processed builds of a dedupCache, with the same
+// TTL, so they survive restarts and are shared between replicas. seen
+// reports only builds a replica finished processing, not claimed ones. claim
+// marks a build as being processed unless any replica processed or claimed
+// it, and release drops the claim of a build that failed.
+type dedupStore interface {
+	seen(key string) (bool, error)
+	claim(key string, ttl time.Duration) (bool, error)
+	release(key string) error
+	mark(key string, ttl time.Duration) error
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultNotifyTimeout = 10 * time.Second
+
+// ChannelResult is the outcome of sending a notification to one channel.
+type ChannelResult struct {
+	Channel string
+	Err     error
+}
+
+// skipped reports whether the channel was not sent to because it is
+// disabled.
+func (r ChannelResult) skipped() bool {
+	return errors.Is(r.Err, ErrChannelDisabled)
+}
+
+// DispatchError is returned when at least one channel failed. It lists the
+// outcome of every channel the notification was sent to.
+type DispatchError struct {
+	Results []ChannelResult
+}
+
+func (e *DispatchError) Error() string {
+	outcomes := make([]string, 0, len(e.Results))
+	for _, r := range e.Results {
+		if r.Err != nil {
+			outcomes = append(outcomes, fmt.Sprintf("%s: %v", r.Channel, r.Err))
+		} else {
+			outcomes = append(outcomes, r.Channel+": ok")
+		}
+	}
+	return "notification failed on some channels (" + strings.Join(outcomes, "; ") + ")"
+}
+
+// Unwrap exposes the channel errors to errors.Is and errors.As.
+func (e *DispatchError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+// Ack policies (ACK_POLICY) decide whether a notification that failed on
+// some channels counts as handled. A handled message is acked; otherwise the
+// error is returned so the receiver redelivers it, which sends it to every
+// channel again, including the ones that already got it.
+const (
+	// ackAny acks once any channel got the notification.
+	ackAny = "any"
+	// ackAll redelivers unless every channel got it.
+	ackAll = "all"
+	// ackCritical redelivers only when a critical channel failed.
+	ackCritical = "critical"
+)
+
+// ackPolicy reads ACK_POLICY. It is empty when unset, in which case failed
+// notifications are reported as with "all" but pull mode still acks them
+// unless MAX_PROCESSING_ATTEMPTS is set.
+func ackPolicy() string {
+	switch policy := os.Getenv("ACK_POLICY"); policy {
+	case "", ackAny, ackAll, ackCritical:
+		return policy
+	default:
+		log.Printf("Ignoring invalid ACK_POLICY=%q", policy)
+		return ""
+	}
+}
+
+// handled reports whether results satisfy the ack policy. Disabled channels
+// are left out, neither delivered nor failed, but a notification every
+// channel skipped is not handled.
+func (p *Processor) handled(results []ChannelResult) bool {
+	skipped := 0
+	for _, r := range results {
+		if r.skipped() {
+			skipped++
+		}
+	}
+	if skipped > 0 && skipped == len(results) {
+		return false
+	}
+	switch p.ackPolicy {
+	case ackAny:
+		for _, r := range results {
+			if r.Err == nil {
+				return true
+			}
+		}
+		return false
+	case ackCritical:
+		for _, r := range results {
+			if ch, ok := p.channels[r.Channel]; r.Err != nil && !r.skipped() && (!ok || ch.critical) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, r := range results {
+		if r.Err != nil && !r.skipped() {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatch renders the template, or its localized version for the channel's
+// locale, for each channel and sends it to all of them
+// in parallel, at most NOTIFY_CONCURRENCY at a time. Every channel gets its
+// own timeout, so a hanging webhook cannot hold up the others.
+func (p *Processor) dispatch(ctx context.Context, names []string, text string, localized map[string]string, data MessageData) ([]ChannelResult, error) {
+	results := make([]ChannelResult, len(names))
+	sem := make(chan struct{}, getEnvInt("NOTIFY_CONCURRENCY", 4))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		results[i].Channel = name
+		ch, ok := p.channels[name]
+		if !ok {
+			results[i].Err = fmt.Errorf("%w: unknown channel %q", ErrConfig, name)
+			continue
+		}
+		wg.Add(1)
+		go func(result *ChannelResult, ch *channel) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			result.Err = p.send(ctx, ch, text, localized, data)
+		}(&results[i], ch)
+	}
+	wg.Wait()
+	if !p.handled(results) {
+		return results, &DispatchError{Results: results}
+	}
+	for _, r := range results {
+		if r.Err != nil && !r.skipped() {
+			logf(ctx, "Acking under ACK_POLICY=%s: %v", p.ackPolicy, &DispatchError{Results: results})
+			break
+		}
+	}
+	return results, nil
+}
+
+// Channel strategies of a rule.
+const (
+	// strategyParallel sends to every channel at once; it is the default.
+	strategyParallel = "parallel"
+	// strategyFailover tries the channels in order and stops at the first
+	// that succeeds.
+	strategyFailover = "failover"
+)
+
+// dispatchWith sends a notification with a rule's channel strategy.
+func (p *Processor) dispatchWith(ctx context.Context, strategy string, names []string, text string, localized map[string]string, data MessageData) ([]ChannelResult, error) {
+	if strategy == strategyFailover {
+		return p.failover(ctx, names, text, localized, data)
+	}
+	return p.dispatch(ctx, names, text, localized, data)
+}
+
+// failover sends to the channels one at a time, in order, until one of them
+// succeeds, passing over disabled ones. It fails only when every channel
+// failed or was skipped.
+func (p *Processor) failover(ctx context.Context, names []string, text string, localized map[string]string, data MessageData) ([]ChannelResult, error) {
+	var results []ChannelResult
+	for _, name := range names {
+		result := ChannelResult{Channel: name}
+		if ch, ok := p.channels[name]; ok {
+			result.Err = p.send(ctx, ch, text, localized, data)
+		} else {
+			result.Err = fmt.Errorf("%w: unknown channel %q", ErrConfig, name)
+		}
+		results = append(results, result)
+		if result.Err == nil {
+			return results, nil
+		}
+		if !result.skipped() {
+			logf(ctx, "Channel %s failed, falling back to the next channel: %v", name, result.Err)
+		}
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return results, &DispatchError{Results: results}
+}
+
+func (p *Processor) send(ctx context.Context, ch *channel, text string, localized map[string]string, data MessageData) error {
+	if t, ok := localized[ch.locale]; ok {
+		text = t
+	}
+	data.Locale = ch.locale
+	// The cooldown summary, which counts held back builds, keeps its text.
+	if data.Suppressed == 0 {
+		switch {
+		case ch.summary:
+			text = summaryTemplate
+		case ch.template != "":
+			text = ch.template
+		}
+	}
+	data.Markdown = rendersMarkdown(ch.notifier)
+	if !data.Markdown {
+		data.Commit.Message = sanitizeMarkdown(data.Commit.Message)
+	}
+	if cn, ok := ch.notifier.(cardNotifier); ok && !ch.summary {
+		data.Card = cn.Card()
+	}
+	message, err := renderMessage(text, data)
+	if err != nil {
+		return fmt.Errorf("%w: render template: %v", ErrConfig, err)
+	}
+	if _, ok := ch.notifier.(threadNotifier); ok && ch.overflow && data.BuildId != "" {
+		if max := ch.limit(); max > 0 && len([]rune(message)) > max {
+			return p.deliverThread(ctx, ch, message, data)
+		}
+	}
+	return p.deliver(ctx, ch, message, data)
+}
+
+// deliverThread sends a message too long for the channel as a one-line
+// summary, followed by the full message split into replies in the summary's
+// thread.
+func (p *Processor) deliverThread(ctx context.Context, ch *channel, message string, data MessageData) error {
+	summary, err := renderMessage(summaryTemplate+threadSummarySuffix, data)
+	if err != nil {
+		return fmt.Errorf("%w: render template: %v", ErrConfig, err)
+	}
+	data.thread = "build-" + data.BuildId + "-" + data.Status
+	if err := p.deliver(ctx, ch, summary, data); err != nil {
+		return err
+	}
+	// Leave room for the MESSAGE_PREFIX and MESSAGE_SUFFIX of each reply.
+	max := ch.limit() - len([]rune(p.prefix)) - len([]rune(p.suffix)) - 2
+	for _, part := range splitMessage(message, max) {
+		if err := p.deliver(ctx, ch, part, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends a rendered message to a channel, with the MESSAGE_PREFIX and
+// MESSAGE_SUFFIX, cut to the notifier's size limit.
+func (p *Processor) deliver(ctx context.Context, ch *channel, message string, data MessageData) error {
+	if message == "" {
+		return nil
+	}
+	if ch.disabled.Load() {
+		logf(ctx, "Channel %s is disabled, skipping the message", ch.name)
+		return fmt.Errorf("%w: %s", ErrChannelDisabled, ch.name)
+	}
+	if p.prefix != "" {
+		message = p.prefix + " " + message
+	}
+	if p.suffix != "" {
+		message = message + " " + p.suffix
+	}
+	message = truncateMessage(message, ch.limit())
+	if p.dryRun && p.recorder != nil {
+		return p.recorder.Channel(ch.name).Notify(ctx, message, data)
+	}
+	if p.dryRun {
+		fmt.Printf("[%s] %s\n", ch.name, message)
+		return nil
+	}
+	return p.notifyEndpoints(ctx, ch, message, data)
+}
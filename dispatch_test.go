@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestProcessor returns a processor whose channels are recorded instead
+// of sent.
+func newTestProcessor(t *testing.T, config *Config) (*Processor, *RecordingNotifier, *fakeClock) {
+	t.Helper()
+	clock := newFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	p := newProcessorWithClock(config, clock)
+	p.offline = true
+	rec := NewRecordingNotifier(clock)
+	rec.Install(p)
+	return p, rec, clock
+}
+
+func twoChannelConfig() *Config {
+	return &Config{HangoutURLs: map[string]string{
+		"primary":   "https://chat.googleapis.com/v1/spaces/primary/messages",
+		"secondary": "https://chat.googleapis.com/v1/spaces/secondary/messages",
+	}}
+}
+
+func TestDisabledChannelIsSkipped(t *testing.T) {
+	p, rec, _ := newTestProcessor(t, twoChannelConfig())
+	p.channels["primary"].disabled.Store(true)
+	ctx := context.Background()
+
+	results, err := p.failover(ctx, []string{"primary", "secondary"}, "hello", nil, MessageData{})
+	if err != nil {
+		t.Fatalf("failover: %v", err)
+	}
+	if len(results) != 2 || !results[0].skipped() {
+		t.Errorf("failover results = %+v, want primary skipped", results)
+	}
+	if got := len(rec.MessagesForChannel("secondary")); got != 1 {
+		t.Errorf("secondary got %d messages, want 1", got)
+	}
+
+	for _, policy := range []string{"", ackAny, ackAll, ackCritical} {
+		p.ackPolicy = policy
+		if _, err := p.dispatch(ctx, []string{"primary"}, "hello", nil, MessageData{}); !errors.Is(err, ErrChannelDisabled) {
+			t.Errorf("ACK_POLICY=%q: dispatch to a disabled channel = %v, want ErrChannelDisabled", policy, err)
+		}
+		if _, err := p.dispatch(ctx, []string{"primary", "secondary"}, "hello", nil, MessageData{}); err != nil {
+			t.Errorf("ACK_POLICY=%q: dispatch with one channel delivered = %v, want nil", policy, err)
+		}
+	}
+	if got := len(rec.MessagesForChannel("primary")); got != 0 {
+		t.Errorf("disabled channel got %d messages", got)
+	}
+}
+
+// failingNotifier fails every message, without retries.
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(ctx context.Context, message string, data MessageData) error {
+	return fmt.Errorf("%w: webhook down", ErrNotifierUnavailable)
+}
+
+func TestParallelStrategy(t *testing.T) {
+	p, rec, _ := newTestProcessor(t, twoChannelConfig())
+	ctx := context.Background()
+	channels := []string{"primary", "secondary"}
+
+	if _, err := p.dispatchWith(ctx, strategyParallel, channels, "hello", nil, MessageData{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.MessagesForChannel("primary")) != 1 || len(rec.MessagesForChannel("secondary")) != 1 {
+		t.Errorf("parallel sent %v, want one message per channel", rec.Messages())
+	}
+
+	// A failing channel doesn't stop the others.
+	rec.Reset()
+	p.channels["primary"].notifier = failingNotifier{}
+	results, err := p.dispatchWith(ctx, strategyParallel, channels, "hello", nil, MessageData{})
+	if !errors.Is(err, ErrNotifierUnavailable) {
+		t.Errorf("parallel with a failing channel = %v, want its error", err)
+	}
+	if len(results) != 2 || results[0].Err == nil || results[1].Err != nil {
+		t.Errorf("parallel results = %+v, want primary failed", results)
+	}
+	if got := len(rec.MessagesForChannel("secondary")); got != 1 {
+		t.Errorf("secondary got %d messages, want 1", got)
+	}
+}
+
+func TestFailoverStrategy(t *testing.T) {
+	p, rec, _ := newTestProcessor(t, twoChannelConfig())
+	ctx := context.Background()
+	channels := []string{"primary", "secondary"}
+
+	// The first channel that works is the only one notified.
+	results, err := p.dispatchWith(ctx, strategyFailover, channels, "hello", nil, MessageData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(rec.MessagesForChannel("primary")) != 1 || len(rec.MessagesForChannel("secondary")) != 0 {
+		t.Errorf("failover sent %v, want only primary", rec.Messages())
+	}
+
+	rec.Reset()
+	p.channels["primary"].notifier = failingNotifier{}
+	results, err = p.dispatchWith(ctx, strategyFailover, channels, "hello", nil, MessageData{})
+	if err != nil {
+		t.Fatalf("failover with a working backup = %v", err)
+	}
+	if len(results) != 2 || results[0].Err == nil || len(rec.MessagesForChannel("secondary")) != 1 {
+		t.Errorf("failover results = %+v, want secondary to take over", results)
+	}
+
+	p.channels["secondary"].notifier = failingNotifier{}
+	if _, err := p.dispatchWith(ctx, strategyFailover, channels, "hello", nil, MessageData{}); !errors.As(err, new(*DispatchError)) {
+		t.Errorf("failover with every channel failing = %v, want a DispatchError", err)
+	}
+}
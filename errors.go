@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error categories returned by the notification pipeline. Callers branch on
+// them with errors.Is; HTTP failures additionally carry a *StatusError.
+var (
+	// ErrConfig means the configuration is missing or invalid. Retrying will
+	// not help until it is fixed.
+	ErrConfig = errors.New("invalid configuration")
+	// ErrInvalidPayload means a message or API response could not be decoded
+	// or encoded.
+	ErrInvalidPayload = errors.New("invalid payload")
+	// ErrNotifierUnavailable means the chat webhook could not be reached or
+	// answered with a transient error; the message may be retried.
+	ErrNotifierUnavailable = errors.New("notifier unavailable")
+	// ErrNotifierRejected means the chat webhook refused the message.
+	ErrNotifierRejected = errors.New("notifier rejected message")
+	// ErrGitHubRateLimited means GitHub throttled the commit lookup.
+	ErrGitHubRateLimited = errors.New("github rate limited")
+	// ErrGitHubNotFound means GitHub does not know the repository or commit.
+	ErrGitHubNotFound = errors.New("github commit not found")
+	// ErrGitHubUnavailable means GitHub could not be reached or failed.
+	ErrGitHubUnavailable = errors.New("github unavailable")
+	// ErrCloudBuildUnavailable means the Cloud Build API could not be reached
+	// or failed.
+	ErrCloudBuildUnavailable = errors.New("cloud build api unavailable")
+	// ErrChannelDisabled means the channel was disabled from the admin
+	// server and the message was not sent.
+	ErrChannelDisabled = errors.New("channel disabled")
+)
+
+// StatusError reports an unexpected HTTP response. It unwraps to its error
+// category, so errors.Is(err, ErrNotifierUnavailable) and
+// errors.As(err, &statusErr) both work on the same value.
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Kind       error
+	// RetryAfter is how long the service asked us to back off, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status %d: %v", e.Service, e.StatusCode, e.Kind)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Kind
+}
+
+// RedeliverError asks the receiver to leave the message unacknowledged and
+// have it redelivered once After has elapsed.
+type RedeliverError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *RedeliverError) Error() string {
+	return fmt.Sprintf("redeliver after %s: %v", e.After, e.Err)
+}
+
+func (e *RedeliverError) Unwrap() error {
+	return e.Err
+}
+
+// errorCategory names the category of err for logs and metrics.
+func errorCategory(err error) string {
+	switch {
+	case err == nil:
+		return "none"
+	case errors.Is(err, ErrConfig):
+		return "config"
+	case errors.Is(err, ErrInvalidPayload):
+		return "invalid_payload"
+	case errors.Is(err, ErrNotifierUnavailable):
+		return "notifier_unavailable"
+	case errors.Is(err, ErrNotifierRejected):
+		return "notifier_rejected"
+	case errors.Is(err, ErrGitHubRateLimited):
+		return "github_rate_limited"
+	case errors.Is(err, ErrGitHubNotFound):
+		return "github_not_found"
+	case errors.Is(err, ErrGitHubUnavailable):
+		return "github_unavailable"
+	case errors.Is(err, ErrCloudBuildUnavailable):
+		return "cloudbuild_unavailable"
+	case errors.Is(err, ErrChannelDisabled):
+		return "channel_disabled"
+	}
+	return "unknown"
+}
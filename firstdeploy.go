@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// firstDeployMarker is put in front of the first successful deploy of the
+// day of a repo and branch, for rules with FirstDeployOfDay.
+const firstDeployMarker = "🌅 First deploy today! "
+
+// firstDeployTracker remembers the day of the last successful deploy per
+// trigger and branch. It lives in memory, so after a restart the next deploy
+// counts as the first of the day again.
+type firstDeployTracker struct {
+	mu   sync.Mutex
+	days map[string]string
+}
+
+func newFirstDeployTracker() *firstDeployTracker {
+	return &firstDeployTracker{days: make(map[string]string)}
+}
+
+// first records a deploy for key at now and reports whether it is the first
+// one of that day in loc.
+func (t *firstDeployTracker) first(key string, now time.Time, loc *time.Location) bool {
+	if loc == nil {
+		loc = time.Local
+	}
+	day := now.In(loc).Format("2006-01-02")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.days[key] == day {
+		return false
+	}
+	t.days[key] = day
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// githubAppAuth authenticates GitHub API calls as a GitHub App installation.
+// It mints an installation token with a short-lived app JWT and refreshes it
+// shortly before it expires (after an hour).
+type githubAppAuth struct {
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var (
+	githubAppOnce sync.Once
+	githubApp     *githubAppAuth
+	githubAppErr  error
+)
+
+// githubAuthorization returns the Authorization header for GitHub API calls:
+// an installation token when GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and
+// GITHUB_APP_PRIVATE_KEY (or GITHUB_APP_PRIVATE_KEY_FILE) are set, otherwise
+// the GITHUB_TOKEN personal access token.
+func githubAuthorization(ctx context.Context) (string, error) {
+	githubAppOnce.Do(func() {
+		githubApp, githubAppErr = newGithubAppAuth()
+	})
+	if githubAppErr != nil {
+		return "", githubAppErr
+	}
+	if githubApp == nil {
+		return fmt.Sprintf("Basic %s", os.Getenv("GITHUB_TOKEN")), nil
+	}
+	token, err := githubApp.installationToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "token " + token, nil
+}
+
+// newGithubAppAuth reads the app credentials, returning nil when they are
+// not configured.
+func newGithubAppAuth() (*githubAppAuth, error) {
+	appID, installationID := os.Getenv("GITHUB_APP_ID"), os.Getenv("GITHUB_APP_INSTALLATION_ID")
+	if appID == "" && installationID == "" {
+		return nil, nil
+	}
+	keyPEM := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if path := os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"); len(keyPEM) == 0 && path != "" {
+		var err error
+		if keyPEM, err = ioutil.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("%w: github app private key: %v", ErrConfig, err)
+		}
+	}
+	if appID == "" || installationID == "" || len(keyPEM) == 0 {
+		return nil, fmt.Errorf("%w: github app auth needs GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and a private key", ErrConfig)
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%w: github app private key: %v", ErrConfig, err)
+	}
+	return &githubAppAuth{appID: appID, installationID: installationID, key: key}, nil
+}
+
+// parseRSAPrivateKey reads the PKCS#1 key GitHub generates, or a PKCS#8 one.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// installationToken returns the cached installation token, minting a new one
+// when it expires within five minutes. The token request is bounded by ctx,
+// so a hanging GitHub does not hold the lock other requests wait on.
+func (a *githubAppAuth) installationToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > 5*time.Minute {
+		return a.token, nil
+	}
+	jwt, err := a.appJWT(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("%w: sign github app jwt: %v", ErrConfig, err)
+	}
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", githubAPI, a.installationID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", githubUserAgent())
+	res, err := sharedHTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: github installation token: %v", ErrGitHubUnavailable, err)
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusCreated {
+		return "", &StatusError{Service: "github", StatusCode: res.StatusCode, Kind: githubErrorKind(res), RetryAfter: githubRetryAfter(res)}
+	}
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: decode github installation token: %v", ErrInvalidPayload, err)
+	}
+	secrets.add(body.Token)
+	a.token, a.expires = body.Token, body.ExpiresAt
+	return a.token, nil
+}
+
+// appJWT signs the RS256 JWT that authenticates as the app itself. It is
+// backdated a minute against clock drift and valid for the allowed maximum
+// of ten minutes less a minute.
+func (a *githubAppAuth) appJWT(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.issuer(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// issuer is the app id, as a number when it is one.
+func (a *githubAppAuth) issuer() interface{} {
+	if id, err := strconv.ParseInt(a.appID, 10, 64); err == nil {
+		return id
+	}
+	return a.appID
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// commitQuery fetches everything notifications show about a commit in one
+// request: message, people, stats and the pull request it belongs to.
+const commitQuery = `query($owner: String!, $repo: String!, $sha: GitObjectID!) {
+  repository(owner: $owner, name: $repo) {
+    object(oid: $sha) {
+      ... on Commit {
+        oid
+        url
+        message
+        additions
+        deletions
+        changedFilesIfAvailable
+        author { name email date user { login } }
+        committer { name email date user { login } }
+        associatedPullRequests(first: 1) { nodes { number title url } }
+      }
+    }
+  }
+}`
+
+type graphQLPerson struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+	User  *struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+func (p graphQLPerson) info() PersonInfo {
+	return PersonInfo{Name: p.Name, Email: p.Email, Date: p.Date}
+}
+
+func (p graphQLPerson) login() string {
+	if p.User == nil {
+		return ""
+	}
+	return p.User.Login
+}
+
+type graphQLCommit struct {
+	OID          string        `json:"oid"`
+	URL          string        `json:"url"`
+	Message      string        `json:"message"`
+	Additions    int           `json:"additions"`
+	Deletions    int           `json:"deletions"`
+	ChangedFiles int           `json:"changedFilesIfAvailable"`
+	Author       graphQLPerson `json:"author"`
+	Committer    graphQLPerson `json:"committer"`
+	PullRequests struct {
+		Nodes []struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+			URL    string `json:"url"`
+		} `json:"nodes"`
+	} `json:"associatedPullRequests"`
+}
+
+type graphQLError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// githubInfo normalizes the commit to the shape of the REST lookups.
+func (c *graphQLCommit) githubInfo() GithubInfo {
+	info := GithubInfo{
+		SHA:            c.OID,
+		HTML_URL:       c.URL,
+		Author:         c.Author.info(),
+		Committer:      c.Committer.info(),
+		Message:        c.Message,
+		AuthorLogin:    c.Author.login(),
+		CommitterLogin: c.Committer.login(),
+		Stats: CommitStats{
+			Total:     c.Additions + c.Deletions,
+			Additions: c.Additions,
+			Deletions: c.Deletions,
+		},
+		ChangedFiles: c.ChangedFiles,
+	}
+	if nodes := c.PullRequests.Nodes; len(nodes) > 0 {
+		info.PullRequest = &PullRequest{Number: nodes[0].Number, Title: nodes[0].Title, HTMLURL: nodes[0].URL}
+	}
+	return info
+}
+
+// getGithubInfoGraphQL looks up a commit and its pull request with a single
+// GraphQL query. GraphQL answers errors with a 200 and an errors list, which
+// are mapped to the same categories as REST failures. The query needs the
+// full SHA, so an abbreviated one is first expanded through REST.
+func getGithubInfoGraphQL(ctx context.Context, commitRSA string, repo string) (GithubInfo, error) {
+	if !fullSHA(commitRSA) {
+		url := fmt.Sprintf("%s/repos/trunghlt/%s/commits/%s", githubAPI, repo, commitRSA)
+		var commit struct {
+			SHA string `json:"sha"`
+		}
+		if err := githubGet(ctx, url, &commit); err != nil {
+			return GithubInfo{}, err
+		}
+		commitRSA = commit.SHA
+	}
+	request := map[string]interface{}{
+		"query":     commitQuery,
+		"variables": map[string]string{"owner": "trunghlt", "repo": repo, "sha": commitRSA},
+	}
+	var response struct {
+		Data struct {
+			Repository *struct {
+				Object *graphQLCommit `json:"object"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []graphQLError `json:"errors"`
+	}
+	if err := githubRequest(ctx, "POST", githubAPI+"/graphql", request, &response); err != nil {
+		return GithubInfo{}, err
+	}
+	if len(response.Errors) > 0 {
+		return GithubInfo{}, graphQLErr(repo, commitRSA, response.Errors)
+	}
+	if response.Data.Repository == nil || response.Data.Repository.Object == nil || response.Data.Repository.Object.OID == "" {
+		return GithubInfo{}, fmt.Errorf("%w: %s@%s", ErrGitHubNotFound, repo, commitRSA)
+	}
+	return response.Data.Repository.Object.githubInfo(), nil
+}
+
+func graphQLErr(repo, sha string, errs []graphQLError) error {
+	kind := ErrGitHubUnavailable
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+		switch e.Type {
+		case "NOT_FOUND":
+			kind = ErrGitHubNotFound
+		case "RATE_LIMITED":
+			kind = ErrGitHubRateLimited
+		}
+	}
+	return fmt.Errorf("%w: github graphql lookup of %s@%s: %s", kind, repo, sha, strings.Join(messages, "; "))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestGraphQLExpandsShortSHA(t *testing.T) {
+	t.Setenv("GITHUB_COMMIT_ENDPOINT", "graphql")
+	const full = "0123456789abcdef0123456789abcdef01234567"
+	useGithubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/trunghlt/api/commits/0123456":
+			w.Write([]byte(`{"sha": "` + full + `"}`))
+		case "/graphql":
+			var request struct {
+				Variables map[string]string `json:"variables"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Variables["sha"] != full {
+				w.Write([]byte(`{"errors": [{"type": "INVALID", "message": "GitObjectID needs a full SHA"}]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"repository": {"object": {"oid": "` + full + `", "message": "Fix the build",
+				"associatedPullRequests": {"nodes": [{"number": 42, "title": "Fix", "url": "https://github.com/trunghlt/api/pull/42"}]}}}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	for _, sha := range []string{"0123456", full} {
+		info, err := GetGithubInfo(context.Background(), sha, "api")
+		if err != nil {
+			t.Errorf("GetGithubInfo(%s): %v", sha, err)
+			continue
+		}
+		if info.SHA != full || info.PullRequest == nil || info.PullRequest.Number != 42 {
+			t.Errorf("GetGithubInfo(%s) = %+v", sha, info)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// BuildRecord is a processed build as listed by the admin server.
+type BuildRecord struct {
+	ID          string    `json:"id"`
+	Repo        string    `json:"repo"`
+	Branch      string    `json:"branch"`
+	Status      string    `json:"status"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	LogURL      string    `json:"logUrl"`
+	FinishTime  time.Time `json:"finishTime"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+func newBuildRecord(build *CloudBuildInfo, outcome string, err error, now time.Time) BuildRecord {
+	record := BuildRecord{
+		ID:          build.ID,
+		Repo:        build.Substitutions.REPONAME,
+		Branch:      build.Substitutions.BRANCHNAME,
+		Status:      build.Status,
+		Outcome:     outcome,
+		LogURL:      build.LogURL,
+		FinishTime:  build.FinishTime,
+		ProcessedAt: now,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// BuildHistory keeps the most recent processed builds in memory.
+type BuildHistory struct {
+	mu      sync.Mutex
+	size    int
+	records []BuildRecord
+}
+
+// NewBuildHistory returns a history of size builds, or nil when size is 0.
+func NewBuildHistory(size int) *BuildHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &BuildHistory{size: size}
+}
+
+func (h *BuildHistory) Add(record BuildRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	if len(h.records) > h.size {
+		h.records = h.records[len(h.records)-h.size:]
+	}
+}
+
+// Recent returns the recorded builds, newest first.
+func (h *BuildHistory) Recent() []BuildRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recent := make([]BuildRecord, len(h.records))
+	for i, r := range h.records {
+		recent[len(recent)-1-i] = r
+	}
+	return recent
+}
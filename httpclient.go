@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+)
+
+// sharedHTTPClient is the client every call to GitHub and the notification
+// webhooks goes through, so their connections are kept alive and reused.
+// HTTP_MAX_IDLE_CONNS_PER_HOST (default 10) and HTTP_IDLE_CONN_TIMEOUT
+// (default 90s) tune its pool. It has no client timeout: callers bound each
+// request with a context deadline, GITHUB_TIMEOUT for GitHub and the channel
+// timeout for webhooks.
+func sharedHTTPClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 10),
+			IdleConnTimeout:       getEnvDuration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+		httpClient = &http.Client{Transport: transport}
+	})
+	return httpClient
+}
+
+// closeBody reads what is left of a response body before closing it, which
+// lets the connection be reused.
+func closeBody(res *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxErrorBody))
+	res.Body.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedHTTPClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha": "abc"}`))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		var v map[string]string
+		if err := githubGet(context.Background(), server.URL, &v); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("5 sequential requests opened %d connections, want 1", n)
+	}
+}
+
+func TestGithubRequestTimesOut(t *testing.T) {
+	t.Setenv("GITHUB_TIMEOUT", "50ms")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	var v map[string]string
+	err := githubGet(context.Background(), server.URL, &v)
+	if !errors.Is(err, ErrGitHubUnavailable) {
+		t.Errorf("hanging GitHub request = %v, want ErrGitHubUnavailable", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hanging GitHub request took %s", elapsed)
+	}
+}
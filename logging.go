@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogging sends all log output, including the standard log package,
+// through slog at the level named by LOG_LEVEL (debug, info, warn or error;
+// info by default). LOG_FORMAT=json writes Cloud Logging structured entries,
+// whose severity and message fields it color-codes and filters on. Known
+// secrets are masked before anything is written; see redactAttr. Entries
+// logged with a context carrying a correlation id are tagged with it.
+func setupLogging() {
+	secrets.add(os.Getenv("GITHUB_TOKEN"), os.Getenv("OPSGENIE_API_KEY"))
+	secrets.addWebhook(os.Getenv("HANGOUT_URL"))
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr})
+	if os.Getenv("LOG_FORMAT") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr})
+	}
+	slog.SetDefault(slog.New(correlationHandler{handler}))
+}
+
+// cloudLoggingAttr renames the level and message attributes to the
+// severity and message fields of a Cloud Logging structured entry.
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 {
+		switch a.Key {
+		case slog.LevelKey:
+			severity := "DEFAULT"
+			switch level := a.Value.Any().(slog.Level); {
+			case level >= slog.LevelError:
+				severity = "ERROR"
+			case level >= slog.LevelWarn:
+				severity = "WARNING"
+			case level >= slog.LevelInfo:
+				severity = "INFO"
+			case level >= slog.LevelDebug:
+				severity = "DEBUG"
+			}
+			return slog.String("severity", severity)
+		case slog.MessageKey:
+			a.Key = "message"
+		}
+	}
+	return redactAttr(groups, a)
+}
+
+// logBuild writes one entry per processed build at a level following its
+// status, so failed builds show up as errors in Cloud Logging.
+func logBuild(ctx context.Context, info *CloudBuildInfo, outcome string) {
+	level := slog.LevelInfo
+	if contains(failureStatuses, info.Status) {
+		level = slog.LevelError
+	}
+	slog.Log(ctx, level, "Build "+info.Status,
+		"repo", info.Substitutions.REPONAME, "branch", info.Substitutions.BRANCHNAME,
+		"build", info.ID, "status", info.Status, "outcome", outcome)
+}
+
+type correlationKey struct{}
+
+// withCorrelation returns ctx carrying the correlation id of a build, which
+// ties together every log entry and notification about it.
+func withCorrelation(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlationID returns the correlation id carried by ctx, if any.
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// newCorrelationID returns a random UUID, for messages without a build id.
+func newCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// correlationHandler adds the correlation id of the context to each entry.
+type correlationHandler struct {
+	slog.Handler
+}
+
+func (h correlationHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := correlationID(ctx); id != "" {
+		r.AddAttrs(slog.String("correlation", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h correlationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationHandler) WithGroup(name string) slog.Handler {
+	return correlationHandler{h.Handler.WithGroup(name)}
+}
+
+// logf logs like log.Printf, tagged with the correlation id of ctx.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	slog.InfoContext(ctx, fmt.Sprintf(format, args...))
+}
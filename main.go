@@ -6,10 +6,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,142 +20,409 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 func init() {
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalln("Failed to load env file")
+	// The .env file is optional: on Cloud Run, for instance, the settings
+	// and APP_CONFIG come from the environment.
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalln("Failed to load env file:", err)
 	}
+	setupLogging()
 }
 
 func main() {
-	ctx := context.Background()
-	proj := os.Getenv("PROJECT_ID")
-	client, err := pubsub.NewClient(ctx, proj)
-	if err != nil {
-		log.Fatalf("Could not create pubsub Client: %v", err)
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	var err error
+	switch command {
+	case "run":
+		err = runCommand(args)
+	case "validate":
+		err = validateCommand(args)
+	case "test-notify":
+		err = testNotifyCommand(args)
+	case "replay":
+		err = replayCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
-	// Pull messages via the subscription.
-	log.Printf("Starting collect notify from cloudbuild server...")
-	if err := pullMsgs(client, "cloudBuildSub"); err != nil {
+	var exit *exitError
+	if errors.As(err, &exit) {
+		log.Print(exit.err)
+		os.Exit(exit.code)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func pullMsgs(client *pubsub.Client, name string) error {
-	var (
-		mu                   sync.Mutex
-		failureStep, message string
-	)
-	sub := client.Subscription(name)
-	err := sub.Receive(context.Background(), func(ctx context.Context, msg *pubsub.Message) {
-		msg.Ack()
-		var cloudBuildInfo CloudBuildInfo
-		err := json.Unmarshal(msg.Data, &cloudBuildInfo)
-		if err != nil {
-			log.Printf("Got err: %s\n", err)
-		}
-		for _, step := range cloudBuildInfo.Steps {
-			if step.Status == "FAILURE" {
-				failureStep = step.ID
+// pullMsgs receives build messages from the subscription and hands them to
+// WORKER_COUNT workers, which bounds how many are processed at once. By
+// default messages are acked once processed, even if processing failed,
+// unless ACK_POLICY is set and the notification did not reach the channels it
+// requires. With MAX_PROCESSING_ATTEMPTS set failed messages are redelivered,
+// up to that many deliveries, before going to the dead letter destination.
+// Either way a RedeliverError (e.g. GitHub rate limiting) nacks the message
+// after its backoff, without holding up the worker.
+func pullMsgs(ctx context.Context, client *pubsub.Client, name string, processor *Processor, deadLetter DeadLetter) error {
+	w := &puller{
+		processor:   processor,
+		deadLetter:  deadLetter,
+		maxAttempts: getEnvInt("MAX_PROCESSING_ATTEMPTS", 0),
+		deliveries:  newAttemptCounter(),
+		stopping:    ctx.Done(),
+	}
+	// Workers finish the messages they took even once ctx is cancelled.
+	workCtx := context.Background()
+	jobs := make(chan pullJob)
+	var wg sync.WaitGroup
+	workers := getEnvInt("WORKER_COUNT", 10)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				w.handle(workCtx, job.msg, job.received)
 			}
+		}()
+	}
+	sub := client.Subscription(name)
+	sub.ReceiveSettings.MaxExtension = getEnvDuration("MAX_ACK_EXTENSION", ackExtension(processor.config))
+	// The callback returns once a worker has taken the message; the worker
+	// acks it when done. Until then the client keeps extending its ack
+	// deadline, for at most MaxExtension.
+	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		jobs <- pullJob{msg: msg, received: time.Now()}
+	})
+	close(jobs)
+	if !waitTimeout(&wg, drainTimeout()) {
+		log.Printf("Messages still processing after DRAIN_TIMEOUT, Pub/Sub will redeliver them")
+	}
+	return err
+}
+
+// ackExtension is how long the client may hold a message unacked: long
+// enough for the longest rule delay plus GitHub lookups and sending. Past it
+// Pub/Sub redelivers the message while it is still being processed; the
+// processor skips the copy as an in-flight duplicate, so it is acked without
+// notifying twice.
+func ackExtension(config *Config) time.Duration {
+	extension := pubsub.DefaultReceiveSettings.MaxExtension
+	if d := config.longestDelay() + 10*time.Minute; d > extension {
+		extension = d
+	}
+	return extension
+}
+
+type pullJob struct {
+	msg      *pubsub.Message
+	received time.Time
+}
+
+// puller processes pulled messages and settles them.
+type puller struct {
+	processor   *Processor
+	deadLetter  DeadLetter
+	maxAttempts int
+	deliveries  *attemptCounter
+	// stopping is closed when Receive stops; messages waiting out a backoff
+	// are nacked then, as Receive only returns once every message is settled.
+	stopping <-chan struct{}
+}
+
+func (w *puller) handle(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	ok, redeliver := w.process(ctx, msg)
+	processingDuration.Observe(time.Since(received).Seconds())
+	switch {
+	case redeliver != nil:
+		nackAfter(w.stopping, msg, redeliver)
+	case ok:
+		ack(msg)
+	default:
+		nack(msg)
+	}
+}
+
+// process processes a message and decides whether it is acked, or
+// redelivered after a RedeliverError's backoff. The push endpoint settles
+// its messages the same way.
+func (w *puller) process(ctx context.Context, msg *pubsub.Message) (ack bool, redeliver *RedeliverError) {
+	attempts := 0
+	if w.maxAttempts > 0 {
+		attempts = deliveryAttempt(w.deliveries, msg)
+	}
+	err := w.processor.Process(ctx, msg.Data, msg.Attributes)
+	if errors.As(err, &redeliver) {
+		return false, redeliver
+	}
+	if w.maxAttempts <= 0 {
+		var dispatchErr *DispatchError
+		if w.processor.ackPolicy != "" && errors.As(err, &dispatchErr) {
+			log.Printf("Redelivering message %s under ACK_POLICY=%s: %v", msg.ID, w.processor.ackPolicy, err)
+			return false, nil
 		}
-		githubData, err := GetGithubInfo(cloudBuildInfo.Substitutions.COMMITSHA, cloudBuildInfo.Substitutions.REPONAME)
 		if err != nil {
-			log.Println(err)
+			log.Printf("Got %s err: %s\n", errorCategory(err), err)
 		}
-		if cloudBuildInfo.Substitutions.BRANCHNAME == "dev" || cloudBuildInfo.Substitutions.BRANCHNAME == "master" {
-			switch cloudBuildInfo.Substitutions.REPONAME {
-			case "superset":
-				if cloudBuildInfo.Status == "SUCCESS" {
-					time.Sleep(6 * time.Minute)
-					message = fmt.Sprintf("The new version of *actable-dev* was available in https://dev-nightly.actable.ai. Detail infomations: ```Repo: %s\nBranch: %s\nCommit message: %s\nCommit Url: %s\nAuthor: %s(%s)\nCommitter:%s(%s)\n```",
-						cloudBuildInfo.Substitutions.REPONAME, cloudBuildInfo.Substitutions.BRANCHNAME, githubData.Message, githubData.HTML_URL,
-						githubData.Author.Name, githubData.Author.Email, githubData.Committer.Name, githubData.Committer.Email)
-				} else if cloudBuildInfo.Status == "FAILURE" {
-					message = fmt.Sprintf("The deployment of *actable-dev* on https://dev-nightly.actable.ai has been stopped with status *%s* at step *%s*. Detail infomations: ```Repo: %s\nBranch: %s\nCommit message: %s\nCommit Url: %s\nAuthor: %s(%s)\nCommitter:%s(%s)\n```",
-						cloudBuildInfo.Status, failureStep, cloudBuildInfo.Substitutions.REPONAME, cloudBuildInfo.Substitutions.BRANCHNAME, githubData.Message, githubData.HTML_URL,
-						githubData.Author.Name, githubData.Author.Email, githubData.Committer.Name, githubData.Committer.Email)
-				}
-			case "ProjectStrand":
-				if cloudBuildInfo.Status == "FAILURE" {
-					buildType := func() string {
-						if cloudBuildInfo.Substitutions.NAMESPACE == "test" {
-							return "unit-testing"
-						}
-						if cloudBuildInfo.Substitutions.BRANCHNAME == "dev" {
-							return "nightly"
-						} else {
-							return "production"
-						}
-					}()
-					message = fmt.Sprintf("Cloud build for *%s* has been finished with status *%s* at step *%s*. Detail infomations: ```Repo: %s\nBranch: %s\nCommit message: %s\nCommit Url: %s\nAuthor: %s(%s)\nCommitter:%s(%s)\n```",
-						buildType, cloudBuildInfo.Status, failureStep, cloudBuildInfo.Substitutions.REPONAME, cloudBuildInfo.Substitutions.BRANCHNAME, githubData.Message, githubData.HTML_URL,
-						githubData.Author.Name, githubData.Author.Email, githubData.Committer.Name, githubData.Committer.Email)
-				}
-			}
-		}
-		if message != "" {
-			err = PushMessageToChatHangout(message)
-			if err != nil {
-				log.Println(err)
-			}
-			message = ""
+		return true, nil
+	}
+	if err == nil || handleFailure(ctx, msg, err, attempts, w.maxAttempts, w.deadLetter) {
+		w.deliveries.forget(msg.ID)
+		return true, nil
+	}
+	return false, nil
+}
+
+// ack and nack settle a message and count the outcome.
+func ack(msg *pubsub.Message) {
+	msg.Ack()
+	messagesTotal.Inc("acked")
+}
+
+func nack(msg *pubsub.Message) {
+	msg.Nack()
+	messagesTotal.Inc("nacked")
+}
+
+// maxRedeliverWait keeps a held message well within the subscription's
+// automatic ack deadline extension.
+const maxRedeliverWait = 10 * time.Minute
+
+// nackAfter nacks msg once the RedeliverError's backoff has passed, or
+// straight away when stopping is closed. It returns at once, so the worker
+// can take the next message meanwhile.
+func nackAfter(stopping <-chan struct{}, msg *pubsub.Message, redeliver *RedeliverError) {
+	wait := redeliver.After
+	if wait > maxRedeliverWait {
+		wait = maxRedeliverWait
+	}
+	log.Printf("Redelivering message %s in %s: %v", msg.ID, wait, redeliver.Err)
+	go func() {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stopping:
 		}
-		mu.Lock()
-		defer mu.Unlock()
-	})
-	if err != nil {
+		nack(msg)
+	}()
+}
+
+func PushMessageToChatHangout(message string) error {
+	messageBody := make(map[string]string)
+	messageBody[hangoutTextField()] = message
+	notifier := NewHangoutNotifier()
+	if err := postToHangout(context.Background(), notifier.URL, messageBody, notifier.isRetryable); err != nil {
 		return err
 	}
+	log.Println("A message has been sent to Cloud-build CI Room: ", message)
 	return nil
 }
 
-func PushMessageToChatHangout(message string) error {
-	url := os.Getenv("HANGOUT_URL")
+// postToHangout sends a Google Chat message body to a webhook url, with
+// retryable classifying its failures; see HangoutNotifier.isRetryable.
+func postToHangout(ctx context.Context, url string, messageBody interface{}, retryable func(statusCode int, body []byte) bool) error {
+	if url == "" {
+		return fmt.Errorf("%w: hangout webhook url is not set", ErrConfig)
+	}
 	method := "POST"
-	messageBody := make(map[string]string)
-	messageBody["text"] = message
 	payload, err := json.Marshal(messageBody)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
 	}
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(payload))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrConfig, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 
-	res, err := client.Do(req)
+	res, err := sharedHTTPClient().Do(req)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrNotifierUnavailable, err)
 	}
+	defer closeBody(res)
 	if res.StatusCode != 200 {
-		return errors.New("Push message to hangout failed ")
+		return responseError("hangout", res, retryable)
 	}
-	log.Println("A message has been sent to Cloud-build CI Room: ", message)
 	return nil
 }
 
-func GetGithubInfo(commitRSA string, repo string) (githubData GithubInfo, err error) {
-	url := fmt.Sprintf("https://api.github.com/repos/trunghlt/%s/git/commits/%s", repo, commitRSA)
-	method := "GET"
+// githubAPI is the base URL of the GitHub REST API, replaced in tests.
+var githubAPI = "https://api.github.com"
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
+// GetGithubInfo looks up a commit. By default it uses the /commits endpoint,
+// which adds the author's GitHub login, stats and files to the git commit;
+// GITHUB_COMMIT_ENDPOINT=git uses the leaner /git/commits endpoint instead,
+// and GITHUB_COMMIT_ENDPOINT=graphql a single GraphQL query that also returns
+// the commit's pull request.
+func GetGithubInfo(ctx context.Context, commitRSA string, repo string) (githubData GithubInfo, err error) {
+	switch os.Getenv("GITHUB_COMMIT_ENDPOINT") {
+	case "graphql":
+		return getGithubInfoGraphQL(ctx, commitRSA, repo)
+	case "git":
+		url := fmt.Sprintf("%s/repos/trunghlt/%s/git/commits/%s", githubAPI, repo, commitRSA)
+		if err := githubGet(ctx, url, &githubData); err != nil {
+			return GithubInfo{}, err
+		}
+		return githubData, nil
+	}
+	url := fmt.Sprintf("%s/repos/trunghlt/%s/commits/%s", githubAPI, repo, commitRSA)
+	var commit repoCommit
+	if err := githubGet(ctx, url, &commit); err != nil {
 		return GithubInfo{}, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", os.Getenv("GITHUB_TOKEN")))
-	res, err := client.Do(req)
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return commit.githubInfo(), nil
+}
+
+// GetGithubPullRequest returns the pull request a commit belongs to, or nil
+// when the commit is not part of one. GitHub lists open PRs first, then
+// merged ones; the first is the most relevant.
+func GetGithubPullRequest(ctx context.Context, commitRSA string, repo string) (*PullRequest, error) {
+	url := fmt.Sprintf("%s/repos/trunghlt/%s/commits/%s/pulls", githubAPI, repo, commitRSA)
+	var pulls []PullRequest
+	if err := githubGet(ctx, url, &pulls); err != nil {
+		return nil, err
+	}
+	if len(pulls) == 0 {
+		return nil, nil
+	}
+	return &pulls[0], nil
+}
+
+// githubGet fetches a GitHub API URL and decodes the JSON response into v.
+// Every failure is returned with the step that failed and its category.
+func githubGet(ctx context.Context, url string, v interface{}) error {
+	return githubRequest(ctx, "GET", url, nil, v)
+}
+
+// githubRequest sends a GitHub API request with an optional JSON body and
+// decodes the JSON response into v. Once it has one of the concurrent
+// request slots, the request, including minting an app token, gets at most
+// GITHUB_TIMEOUT (default 10s).
+func githubRequest(ctx context.Context, method, url string, body interface{}, v interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("%w: github request %s: %v", ErrInvalidPayload, url, err)
+		}
+		payload = bytes.NewReader(data)
+	}
+	release, err := acquireGithubSlot(ctx)
 	if err != nil {
-		return GithubInfo{}, err
+		return fmt.Errorf("%w: github request %s: %v", ErrGitHubUnavailable, url, err)
 	}
-	err = json.Unmarshal(body, &githubData)
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, getEnvDuration("GITHUB_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
 	if err != nil {
-		return GithubInfo{}, err
+		return fmt.Errorf("%w: github request %s: %v", ErrConfig, url, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	auth, err := githubAuthorization(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", auth)
+	req.Header.Set("User-Agent", githubUserAgent())
+	res, err := sharedHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: github request %s: %v", ErrGitHubUnavailable, url, err)
+	}
+	if res.Body == nil {
+		return fmt.Errorf("%w: github response for %s has no body", ErrGitHubUnavailable, url)
+	}
+	defer closeBody(res)
+	if res.StatusCode != 200 {
+		return &StatusError{Service: "github", StatusCode: res.StatusCode, Kind: githubErrorKind(res), RetryAfter: githubRetryAfter(res)}
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("%w: read github response for %s: %v", ErrGitHubUnavailable, url, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: decode github response for %s: %v", ErrInvalidPayload, url, err)
+	}
+	return nil
+}
+
+var (
+	githubSlotsOnce sync.Once
+	githubSlots     chan struct{}
+)
+
+// acquireGithubSlot waits for one of the GITHUB_MAX_CONCURRENCY (default 4)
+// GitHub requests allowed at once, for at most GITHUB_QUEUE_TIMEOUT or until
+// ctx is done, so a burst of builds doesn't trip GitHub's secondary rate
+// limit.
+func acquireGithubSlot(ctx context.Context) (release func(), err error) {
+	githubSlotsOnce.Do(func() {
+		n := getEnvInt("GITHUB_MAX_CONCURRENCY", 4)
+		if n < 1 {
+			n = 1
+		}
+		githubSlots = make(chan struct{}, n)
+	})
+	timeout := time.NewTimer(getEnvDuration("GITHUB_QUEUE_TIMEOUT", 30*time.Second))
+	defer timeout.Stop()
+	select {
+	case githubSlots <- struct{}{}:
+		return func() { <-githubSlots }, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("timed out waiting for one of %d concurrent requests", cap(githubSlots))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// githubUserAgent identifies the notifier to GitHub, which asks API clients
+// for a descriptive User-Agent. GITHUB_USER_AGENT overrides the default.
+func githubUserAgent() string {
+	if ua := os.Getenv("GITHUB_USER_AGENT"); ua != "" {
+		return ua
+	}
+	return "cloudbuildnotifier/" + version
+}
+
+// githubErrorKind maps a non-200 GitHub response to an error category.
+// GitHub signals rate limiting with 403 or 429 plus rate limit headers; the
+// secondary (abuse) limit comes as a 403 with Retry-After.
+func githubErrorKind(res *http.Response) error {
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrGitHubNotFound
+	case res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode == http.StatusForbidden && (res.Header.Get("X-RateLimit-Remaining") == "0" || res.Header.Get("Retry-After") != ""):
+		return ErrGitHubRateLimited
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		return ErrConfig
+	}
+	return ErrGitHubUnavailable
+}
+
+// githubRetryAfter reads the backoff GitHub asks for: Retry-After seconds for
+// the secondary rate limit, or the X-RateLimit-Reset time for the primary one.
+func githubRetryAfter(res *http.Response) time.Duration {
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if d := time.Until(time.Unix(reset, 0)); d > 0 {
+				return d
+			}
+		}
 	}
-	return githubData, nil
+	return 0
 }
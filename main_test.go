@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// useGithubAPI points the GitHub requests at handler for the test.
+func useGithubAPI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	old := githubAPI
+	githubAPI = server.URL
+	t.Cleanup(func() { githubAPI = old })
+	return server
+}
+
+func TestGithubRequestSetsUserAgent(t *testing.T) {
+	var got string
+	useGithubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+		w.Write([]byte(`{}`))
+	})
+
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"", "cloudbuildnotifier/" + version},
+		{"acme-notifier/2.0", "acme-notifier/2.0"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GITHUB_USER_AGENT", tt.env)
+		if _, err := GetGithubInfo(context.Background(), "abc1234", "api"); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("GITHUB_USER_AGENT=%q: User-Agent = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestGetGithubInfo(t *testing.T) {
+	useGithubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/repos/trunghlt/api/") || !strings.HasSuffix(r.URL.Path, "/commits/abc1234") {
+			http.NotFound(w, r)
+			return
+		}
+		// Both the /git/commits and the /commits shape of the commit.
+		w.Write([]byte(`{"sha": "abc1234", "html_url": "https://github.com/trunghlt/api/commit/abc1234",
+			"message": "Fix the build", "author": {"name": "Octo Cat", "login": "octocat"},
+			"commit": {"message": "Fix the build", "author": {"name": "Octo Cat"}}}`))
+	})
+	info, err := GetGithubInfo(context.Background(), "abc1234", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SHA != "abc1234" || info.Message != "Fix the build" || info.Author.Name != "Octo Cat" {
+		t.Errorf("GetGithubInfo = %+v", info)
+	}
+}
+
+func TestChangedFilesCapped(t *testing.T) {
+	for _, tt := range []struct {
+		files int
+		want  string
+	}{
+		{3, "3"},
+		{githubCommitFilesLimit - 1, "299"},
+		// GitHub cuts the list, so the commit changed at least as many.
+		{githubCommitFilesLimit, "300+"},
+	} {
+		commit := repoCommit{Files: make([]CommitFile, tt.files)}
+		info := commit.githubInfo()
+		data := MessageData{FilesChanged: info.ChangedFiles, FilesChangedCapped: info.ChangedFilesCapped}
+		if got := data.FilesChangedText(); got != tt.want {
+			t.Errorf("%d files listed: FilesChangedText = %q, want %q", tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestGetGithubInfoErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    error
+		status  int
+	}{
+		{
+			name:    "unknown commit",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			want:    ErrGitHubNotFound,
+			status:  http.StatusNotFound,
+		},
+		{
+			name: "rate limited",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.WriteHeader(http.StatusForbidden)
+			},
+			want:   ErrGitHubRateLimited,
+			status: http.StatusForbidden,
+		},
+		{
+			name:    "bad credentials",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) },
+			want:    ErrConfig,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) },
+			want:    ErrGitHubUnavailable,
+			status:  http.StatusBadGateway,
+		},
+		{
+			name:    "bad JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"sha": `)) },
+			want:    ErrInvalidPayload,
+		},
+		{
+			name: "transport error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// Drop the connection without a response.
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			want: ErrGitHubUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGithubAPI(t, tt.handler)
+			_, err := GetGithubInfo(context.Background(), "abc1234", "api")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("GetGithubInfo error = %v, want %v", err, tt.want)
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) != (tt.status != 0) || tt.status != 0 && statusErr.StatusCode != tt.status {
+				t.Errorf("GetGithubInfo error = %#v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestRateLimitedMessageDoesNotBlockWorker(t *testing.T) {
+	t.Setenv("WORKER_COUNT", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := pstest.NewServer()
+	defer server.Close()
+	conn, err := grpc.Dial(server.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(ctx, "proj", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "cloud-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateSubscription(ctx, "notifier", pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, n := newCaptureProcessor(t, testConfig(t, teamConfig))
+	p.redeliver = true
+	// GitHub rate limits the first lookup for 10 minutes.
+	var lookups int32
+	useGithubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			w.Header().Set("Retry-After", "600")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	for _, id := range []string{"build-1", "build-2"} {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: buildPayload(id, "SUCCESS", "api", "main")}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- pullMsgs(ctx, client, "notifier", p, nil) }()
+	// The only worker moves on to the other build while the rate limited
+	// one waits to be redelivered.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.sent()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the other build was not notified while the rate limited one waited")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping nacks the waiting message instead of holding up Receive.
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pullMsgs still waiting for the rate limited message")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// markdownNotifier is implemented by notifiers that report whether their
+// channel renders markdown. Commit messages sent to channels that don't, or
+// to notifiers that don't say, are sanitized by sanitizeMarkdown.
+type markdownNotifier interface {
+	Markdown() bool
+}
+
+func rendersMarkdown(n Notifier) bool {
+	mn, ok := n.(markdownNotifier)
+	return ok && mn.Markdown()
+}
+
+var (
+	markdownLink   = regexp.MustCompile(`\[([^\]]*)\]\(([^)\s]*)\)`)
+	markdownHeader = regexp.MustCompile(`(?m)^#{1,6}[ \t]+`)
+	markdownBold   = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+)
+
+// markdownSpecial are the characters escaped by COMMIT_MARKDOWN=escape.
+const markdownSpecial = "\\`*_[]()#~>|"
+
+// sanitizeMarkdown makes a commit message read well where markdown is shown
+// as is. With COMMIT_MARKDOWN=escape the markup is backslash-escaped, with
+// "keep" it is left alone; by default it is stripped: links become
+// "text (url)", and bold, headers and backticks are removed.
+func sanitizeMarkdown(message string) string {
+	switch os.Getenv("COMMIT_MARKDOWN") {
+	case "keep":
+		return message
+	case "escape":
+		var b strings.Builder
+		for _, r := range message {
+			if strings.ContainsRune(markdownSpecial, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	message = markdownLink.ReplaceAllString(message, "$1 ($2)")
+	message = markdownHeader.ReplaceAllString(message, "")
+	message = markdownBold.ReplaceAllString(message, "$2")
+	return strings.Replace(message, "`", "", -1)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics are kept in memory and served in the Prometheus text format on the
+// admin server's /metrics endpoint.
+var (
+	processingDuration = newHistogram("cloudbuild_processing_duration_seconds",
+		"Time from receiving a build message to finishing its notification.",
+		[]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600})
+	messagesTotal = newCounter("cloudbuild_messages_total",
+		"Build messages acked or nacked, by result.", "result")
+	// The repo and branch labels only take values named in the config, see
+	// Config.metricLabels, so arbitrary builds cannot add series without
+	// bound. Breaking down by more (e.g. substitutions) would need the same
+	// guard.
+	notificationsSent = newCounter("cloudbuild_notifications_sent_total",
+		"Notifications sent, by repo, branch and build status. Unconfigured repos and branches are counted as \"other\".",
+		"repo", "branch", "status")
+	// The field label only takes the paths the bundled payload schema names.
+	payloadSchemaMismatches = newCounter("cloudbuild_payload_schema_mismatches_total",
+		"Fields of build messages that did not match the payload schema, with VALIDATE_PAYLOADS=true.",
+		"field")
+)
+
+// metrics lists everything /metrics serves, in order.
+var metrics = []metric{processingDuration, messagesTotal, notificationsSent, payloadSchemaMismatches}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter is a Prometheus counter with labels.
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu sync.Mutex
+	// values is keyed by the label values joined with labelSep.
+	values map[string]float64
+}
+
+const labelSep = "\xff"
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the series with the label values, in the order of labels.
+func (c *counter) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(values, labelSep)]++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		pairs := make([]string, len(c.labels))
+		for i, value := range strings.Split(v, labelSep) {
+			pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], value)
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, strings.Join(pairs, ","), c.values[v])
+	}
+}
+
+// histogram is a Prometheus histogram without labels.
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 type CloudBuildInfo struct {
 	ID               string           `json:"id"`
@@ -21,13 +26,76 @@ type CloudBuildInfo struct {
 	Substitutions    Substitutions    `json:"substitutions"`
 	Tags             []string         `json:"tags"`
 	Timing           interface{}      `json:"timing"`
+	// FailureInfo is set by Cloud Build on some failed builds.
+	FailureInfo *FailureInfo `json:"failureInfo"`
 }
+
+// FailureInfo describes why a build failed, e.g. type "PUSH_FAILED" with
+// the registry's error as detail.
+type FailureInfo struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// validSHA reports whether sha looks like a git commit SHA, abbreviated or
+// full, worth looking up on GitHub.
+func validSHA(sha string) bool {
+	if len(sha) < 7 || len(sha) > 64 {
+		return false
+	}
+	for _, r := range sha {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// fullSHA reports whether sha is a full 40 character SHA-1 commit id, as
+// GraphQL's GitObjectID requires.
+func fullSHA(sha string) bool {
+	return len(sha) == 40 && validSHA(sha)
+}
+
+// checkBuild returns an ErrInvalidPayload error unless a decoded message has
+// the shape of a Cloud Build status message, rather than some other JSON
+// sent to the topic: an id, a status and the REPO_NAME and BRANCH_NAME (or
+// TAG_NAME) substitutions rules match on.
+func (c *CloudBuildInfo) checkBuild() error {
+	switch {
+	case c.ID == "" || c.Status == "":
+		return fmt.Errorf("%w: no build id or status", ErrInvalidPayload)
+	case c.Substitutions.REPONAME == "":
+		return fmt.Errorf("%w: no REPO_NAME substitution", ErrInvalidPayload)
+	case c.Substitutions.BRANCHNAME == "" && c.Substitutions.TAGNAME == "":
+		return fmt.Errorf("%w: no BRANCH_NAME or TAG_NAME substitution", ErrInvalidPayload)
+	}
+	return nil
+}
+
+// queueTime is how long the build waited before it started, or 0 before it
+// has.
+func (c *CloudBuildInfo) queueTime() time.Duration {
+	if c.CreateTime.IsZero() || c.StartTime.IsZero() {
+		return 0
+	}
+	return c.StartTime.Sub(c.CreateTime)
+}
+
 type StorageSource struct {
 	Bucket string `json:"bucket"`
 	Object string `json:"object"`
 }
 type Source struct {
 	StorageSource StorageSource `json:"storageSource"`
+	RepoSource    RepoSource    `json:"repoSource"`
+}
+type RepoSource struct {
+	ProjectID  string `json:"projectId"`
+	RepoName   string `json:"repoName"`
+	BranchName string `json:"branchName"`
+	TagName    string `json:"tagName"`
+	CommitSha  string `json:"commitSha"`
 }
 type Timing struct {
 	StartTime time.Time `json:"startTime"`
@@ -60,6 +128,7 @@ type ResolvedStorageSource struct {
 
 type SourceProvenance struct {
 	ResolvedStorageSource ResolvedStorageSource `json:"resolvedStorageSource"`
+	ResolvedRepoSource    RepoSource            `json:"resolvedRepoSource"`
 	FileHashes            interface{}           `json:"fileHashes"`
 }
 type Options struct {
@@ -72,6 +141,7 @@ type Substitutions struct {
 	REPONAME            string `json:"REPO_NAME"`
 	REVISIONID          string `json:"REVISION_ID"`
 	SHORTSHA            string `json:"SHORT_SHA"`
+	TAGNAME             string `json:"TAG_NAME"`
 	BASEBRANCH          string `json:"_BASE_BRANCH"`
 	DEPLOYERIMAGE       string `json:"_DEPLOYER_IMAGE"`
 	FULFILLMENTIMAGE    string `json:"_FULFILLMENT_IMAGE"`
@@ -84,6 +154,22 @@ type Substitutions struct {
 	PRNUMBER            string `json:"_PR_NUMBER"`
 	SPARKJOBSERVERIMAGE string `json:"_SPARK_JOBSERVER_IMAGE"`
 	SUPERSETIMAGE       string `json:"_SUPERSET_IMAGE"`
+	// All holds every substitution of the build, including custom ones
+	// without a dedicated field.
+	All map[string]string `json:"-"`
+}
+
+func (s *Substitutions) UnmarshalJSON(data []byte) error {
+	type plain Substitutions
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.All)
+}
+
+// Get returns the value of the substitution key, e.g. "_NAMESPACE".
+func (s Substitutions) Get(key string) string {
+	return s.All[key]
 }
 
 type GithubInfo struct {
@@ -97,6 +183,97 @@ type GithubInfo struct {
 	Message      string       `json:"message"`
 	Parents      []Parent     `json:"parents"`
 	Verification Verification `json:"verification"`
+	// AuthorLogin, CommitterLogin, Stats and ChangedFiles are only returned
+	// by the /commits endpoint and GraphQL, Files only by /commits; see
+	// GITHUB_COMMIT_ENDPOINT. /commits lists at most 300 files, so there
+	// ChangedFiles stops at 300 and ChangedFilesCapped is set; GraphQL
+	// counts them all.
+	AuthorLogin        string       `json:"-"`
+	CommitterLogin     string       `json:"-"`
+	Stats              CommitStats  `json:"-"`
+	Files              []CommitFile `json:"-"`
+	ChangedFiles       int          `json:"-"`
+	ChangedFilesCapped bool         `json:"-"`
+	// PullRequest is set by the GraphQL lookup, which returns the commit's
+	// pull request with it.
+	PullRequest *PullRequest `json:"-"`
+}
+
+// repoCommit is a commit as returned by the /repos/{repo}/commits/{sha}
+// endpoint, which wraps the git commit in GitHub metadata.
+type repoCommit struct {
+	SHA     string `json:"sha"`
+	NodeID  string `json:"node_id"`
+	URL     string `json:"url"`
+	HTMLURL string `json:"html_url"`
+	Commit  struct {
+		Author       PersonInfo   `json:"author"`
+		Committer    PersonInfo   `json:"committer"`
+		Tree         Tree         `json:"tree"`
+		Message      string       `json:"message"`
+		Verification Verification `json:"verification"`
+	} `json:"commit"`
+	Author    *GithubUser  `json:"author"`
+	Committer *GithubUser  `json:"committer"`
+	Parents   []Parent     `json:"parents"`
+	Stats     CommitStats  `json:"stats"`
+	Files     []CommitFile `json:"files"`
+}
+
+// githubCommitFilesLimit is the most files the /commits endpoint lists; a
+// commit changing more has them cut at that many.
+const githubCommitFilesLimit = 300
+
+// githubInfo normalizes the commit to the /git/commits shape.
+func (c *repoCommit) githubInfo() GithubInfo {
+	info := GithubInfo{
+		SHA:                c.SHA,
+		NodeID:             c.NodeID,
+		URL:                c.URL,
+		HTML_URL:           c.HTMLURL,
+		Author:             c.Commit.Author,
+		Committer:          c.Commit.Committer,
+		Tree:               c.Commit.Tree,
+		Message:            c.Commit.Message,
+		Parents:            c.Parents,
+		Verification:       c.Commit.Verification,
+		Stats:              c.Stats,
+		Files:              c.Files,
+		ChangedFiles:       len(c.Files),
+		ChangedFilesCapped: len(c.Files) >= githubCommitFilesLimit,
+	}
+	// GitHub leaves the users out when the email matches no account.
+	if c.Author != nil {
+		info.AuthorLogin = c.Author.Login
+	}
+	if c.Committer != nil {
+		info.CommitterLogin = c.Committer.Login
+	}
+	return info
+}
+
+type GithubUser struct {
+	Login string `json:"login"`
+}
+
+type CommitStats struct {
+	Total     int `json:"total"`
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+}
+
+type CommitFile struct {
+	Filename  string `json:"filename"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// PullRequest is the part of a GitHub pull request shown in notifications.
+type PullRequest struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
 }
 
 type PersonInfo struct {
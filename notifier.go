@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Notifier delivers a rendered message, along with the data it was rendered
+// from, to a chat channel. Implementations must give up once ctx is done.
+type Notifier interface {
+	Notify(ctx context.Context, message string, data MessageData) error
+}
+
+// threadNotifier is implemented by notifiers that can post a message as a
+// reply in a thread, named by MessageData.thread.
+type threadNotifier interface {
+	Threads() bool
+}
+
+// cardNotifier is implemented by notifiers that show the commit message
+// outside the rendered text.
+type cardNotifier interface {
+	Card() bool
+}
+
+// legacyChannel is the channel name of the HANGOUT_URL webhook. Rules without
+// channels send to it.
+const legacyChannel = "hangout"
+
+// channel is a configured notifier with its delivery settings.
+type channel struct {
+	name     string
+	notifier Notifier
+	timeout  time.Duration
+	critical bool
+	locale   string
+	// summary renders build notifications as a one-line summary instead of
+	// the rule's template.
+	summary bool
+	// template replaces the rule's template; see ChannelConfig.Template.
+	template string
+	// maxLength and overflow are ChannelConfig.MaxLength and OverflowThread.
+	maxLength int
+	overflow  bool
+	// backups are the endpoints of ChannelConfig.BackupURLs.
+	backups []backupEndpoint
+	// disabled channels skip their messages; operators toggle it with the
+	// admin /channels endpoints.
+	disabled atomic.Bool
+}
+
+// backupEndpoint is a backup endpoint of a channel, named in logs by its
+// redacted URL.
+type backupEndpoint struct {
+	name     string
+	notifier Notifier
+}
+
+// limit is the longest message the channel is sent, or 0 for no limit.
+func (ch *channel) limit() int {
+	max := 0
+	if ln, ok := ch.notifier.(limitedNotifier); ok {
+		max = ln.MaxLength()
+	}
+	if ch.maxLength > 0 && (max == 0 || ch.maxLength < max) {
+		max = ch.maxLength
+	}
+	return max
+}
+
+// newChannels builds the notifiers for the configured channels and hangout
+// URLs, plus the legacy HANGOUT_URL channel unless the config defines its own
+// "hangout".
+func newChannels(config *Config) map[string]*channel {
+	channels := make(map[string]*channel)
+	for name, url := range config.HangoutURLs {
+		secrets.addWebhook(url)
+		channels[name] = &channel{
+			name:     name,
+			notifier: &HangoutNotifier{URL: url},
+			timeout:  defaultNotifyTimeout,
+		}
+	}
+	for name, cc := range config.Channels {
+		secrets.addWebhook(cc.url())
+		timeout := time.Duration(cc.Timeout)
+		if timeout <= 0 {
+			timeout = defaultNotifyTimeout
+		}
+		notifier, err := newNotifier(cc)
+		if err != nil {
+			log.Printf("Could not set up channel %s: %v", name, err)
+			continue
+		}
+		var backups []backupEndpoint
+		for _, u := range cc.BackupURLs {
+			secrets.addWebhook(u)
+			backup := cc
+			backup.URL, backup.URLEnv = u, ""
+			n, err := newNotifier(backup)
+			if err != nil {
+				log.Printf("Could not set up a backup endpoint of channel %s: %v", name, err)
+				continue
+			}
+			backups = append(backups, backupEndpoint{name: redactRawURL(u), notifier: n})
+		}
+		channels[name] = &channel{
+			name:     name,
+			notifier: notifier,
+			backups:  backups,
+			timeout:  timeout,
+			critical: cc.Critical,
+			locale:   cc.Locale,
+			summary:  cc.SummaryMode,
+			template: cc.Template,
+
+			maxLength: cc.MaxLength,
+			overflow:  cc.OverflowThread,
+		}
+	}
+	for _, ch := range channels {
+		if ch.locale == "" {
+			ch.locale = defaultLocale
+		}
+	}
+	if _, ok := channels[legacyChannel]; !ok {
+		channels[legacyChannel] = &channel{
+			name:     legacyChannel,
+			notifier: NewHangoutNotifier(),
+			timeout:  defaultNotifyTimeout,
+			locale:   defaultLocale,
+			summary:  os.Getenv("SUMMARY_MODE") == "true",
+		}
+	}
+	return channels
+}
+
+// notifierTypes holds the channel types that are only built with a build
+// tag, such as "sns".
+var notifierTypes = map[string]func(cc ChannelConfig) (Notifier, error){}
+
+func newNotifier(cc ChannelConfig) (Notifier, error) {
+	if newOptional, ok := notifierTypes[cc.Type]; ok {
+		return newOptional(cc)
+	}
+	if cc.Type == "opsgenie" {
+		return NewOpsgenieNotifier(cc.url(), cc.Priorities), nil
+	}
+	return &HangoutNotifier{URL: cc.url(), Format: cc.Format, PlainText: cc.PlainText}, nil
+}
+
+// HangoutNotifier posts to a Google Chat webhook. With Format "card" the
+// commit message is moved out of the text into a card.
+type HangoutNotifier struct {
+	URL    string
+	Format string
+	// PlainText marks webhooks that show markdown as is.
+	PlainText bool
+}
+
+// NewHangoutNotifier returns the notifier for the HANGOUT_URL webhook.
+func NewHangoutNotifier() *HangoutNotifier {
+	return &HangoutNotifier{URL: os.Getenv("HANGOUT_URL"), Format: os.Getenv("HANGOUT_FORMAT")}
+}
+
+// hangoutMaxLength is the longest message text Google Chat accepts.
+const hangoutMaxLength = 4096
+
+func (n *HangoutNotifier) MaxLength() int {
+	return hangoutMaxLength
+}
+
+// Markdown reports that Google Chat renders its markdown subset, unless the
+// channel is a plain text chat-compatible webhook.
+func (n *HangoutNotifier) Markdown() bool {
+	return !n.PlainText
+}
+
+// Threads reports that Google Chat webhooks can reply in a thread.
+func (n *HangoutNotifier) Threads() bool {
+	return true
+}
+
+// Card reports whether messages are rendered for the card layout.
+func (n *HangoutNotifier) Card() bool {
+	return n.Format == "card"
+}
+
+func (n *HangoutNotifier) Notify(ctx context.Context, message string, data MessageData) error {
+	body := map[string]interface{}{hangoutTextField(): message}
+	if data.Card {
+		body = hangoutCardMessage(message, data.Commit.Message)
+	}
+	url := n.URL
+	if data.thread != "" {
+		body["thread"] = map[string]string{"threadKey": data.thread}
+		url = hangoutThreadURL(url)
+	}
+	if err := postToHangout(ctx, url, body, n.isRetryable); err != nil {
+		return err
+	}
+	logf(ctx, "A message has been sent to Cloud-build CI Room: %s", message)
+	return nil
+}
+
+// isRetryable retries rate limiting and server errors. Google Chat reports
+// its per-space quota as RESOURCE_EXHAUSTED, which chat-compatible webhooks
+// may send with a status other than 429.
+func (n *HangoutNotifier) isRetryable(statusCode int, body []byte) bool {
+	return statusRetryable(statusCode) || bytes.Contains(body, []byte("RESOURCE_EXHAUSTED"))
+}
+
+// hangoutThreadURL makes a webhook post into the thread named in the message,
+// starting it when it does not exist yet.
+func hangoutThreadURL(webhook string) string {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return webhook
+	}
+	q := u.Query()
+	q.Set("messageReplyOption", "REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// hangoutTextField is the JSON key of the message text, "text" for Google
+// Chat. HANGOUT_TEXT_FIELD changes it for chat-compatible webhooks that
+// expect e.g. "message".
+func hangoutTextField() string {
+	if field := os.Getenv("HANGOUT_TEXT_FIELD"); field != "" {
+		return field
+	}
+	return "text"
+}
+
+// hangoutCardMessage keeps the rendered text, with its monospace metadata
+// block, as the message text and shows the commit message as a paragraph.
+func hangoutCardMessage(text, commitMessage string) map[string]interface{} {
+	paragraph := map[string]interface{}{
+		"textParagraph": map[string]string{"text": commitParagraph(commitMessage)},
+	}
+	section := map[string]interface{}{
+		"header":  "Commit message",
+		"widgets": []interface{}{paragraph},
+	}
+	return map[string]interface{}{
+		hangoutTextField(): text,
+		"cards":            []interface{}{map[string]interface{}{"sections": []interface{}{section}}},
+	}
+}
+
+// commitParagraph escapes a commit message for a card textParagraph, which
+// accepts a small HTML subset, and keeps its line breaks.
+func commitParagraph(message string) string {
+	message = strings.TrimSpace(strings.Replace(message, "\r\n", "\n", -1))
+	if message == "" {
+		return "<i>No commit message</i>"
+	}
+	return strings.Replace(html.EscapeString(message), "\n", "<br>", -1)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestHangoutTextField(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode webhook body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		env    string
+		format string
+		want   string
+	}{
+		{env: "", want: "text"},
+		{env: "message", want: "message"},
+		{env: "message", format: "card", want: "message"},
+	}
+	for _, tt := range tests {
+		t.Setenv("HANGOUT_TEXT_FIELD", tt.env)
+		n := &HangoutNotifier{URL: server.URL, Format: tt.format}
+		if err := n.Notify(context.Background(), "Build SUCCESS", MessageData{}); err != nil {
+			t.Fatal(err)
+		}
+		if body[tt.want] != "Build SUCCESS" {
+			t.Errorf("HANGOUT_TEXT_FIELD=%q format=%q: body = %v, want the text under %q", tt.env, tt.format, body, tt.want)
+		}
+		if tt.want != "text" {
+			if _, ok := body["text"]; ok {
+				t.Errorf("HANGOUT_TEXT_FIELD=%q format=%q: body still has a text key: %v", tt.env, tt.format, body)
+			}
+		}
+	}
+}
+
+func TestTruncateMessageBytes(t *testing.T) {
+	message := strings.Repeat("é", 100)
+	for max := len(truncatedMarker); max < len(message); max++ {
+		got := truncateMessageBytes(message, max)
+		if len(got) > max {
+			t.Errorf("max %d: got %d bytes", max, len(got))
+		}
+		if !utf8.ValidString(got) || !strings.HasSuffix(got, truncatedMarker) {
+			t.Errorf("max %d: got %q", max, got)
+		}
+	}
+	if got := truncateMessageBytes(message, len(message)); got != message {
+		t.Errorf("message that fits was truncated: %q", got)
+	}
+	fenced := "```\n" + strings.Repeat("ü", 50)
+	if got := truncateMessageBytes(fenced, 60); len(got) > 60 || strings.Count(got, "```") != 2 {
+		t.Errorf("fenced: got %q (%d bytes)", got, len(got))
+	}
+}
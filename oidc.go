@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var errInvalidToken = errors.New("invalid token")
+
+// oidcVerifier checks the Google-signed OIDC tokens Pub/Sub attaches to push
+// requests.
+type oidcVerifier struct {
+	audience string
+	email    string
+	certsURL string
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// tried is when the keys were last fetched, successfully or not.
+	tried time.Time
+}
+
+func newOIDCVerifier(audience, email string) *oidcVerifier {
+	return &oidcVerifier{audience: audience, email: email, certsURL: googleCertsURL}
+}
+
+type oidcClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Expiry        int64  `json:"exp"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// Verify checks the token signature, issuer, audience, expiry and, when
+// configured, the service account email.
+func (v *oidcVerifier) Verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("%w: unexpected alg %q", errInvalidToken, header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+	switch {
+	case claims.Issuer != "accounts.google.com" && claims.Issuer != "https://accounts.google.com":
+		return fmt.Errorf("%w: unexpected issuer %q", errInvalidToken, claims.Issuer)
+	case claims.Audience != v.audience:
+		return fmt.Errorf("%w: unexpected audience %q", errInvalidToken, claims.Audience)
+	case time.Now().Unix() > claims.Expiry:
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	case v.email != "" && (claims.Email != v.email || !claims.EmailVerified):
+		return fmt.Errorf("%w: unexpected email %q", errInvalidToken, claims.Email)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return nil
+}
+
+// key returns the Google signing key with the given id, refreshing the
+// cached set hourly or when an unknown key id shows up after a rotation.
+// When the hourly refresh fails the cached key is still used, and the
+// refresh is tried again a minute later.
+func (v *oidcVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	if ok && (time.Since(v.fetched) < time.Hour || time.Since(v.tried) < time.Minute) {
+		return key, nil
+	}
+	// Don't let a stream of bogus key ids hammer the certs endpoint.
+	if !ok && time.Since(v.tried) < time.Minute {
+		return nil, fmt.Errorf("%w: unknown key id %q", errInvalidToken, kid)
+	}
+	v.tried = time.Now()
+	keys, err := fetchJWKS(v.certsURL)
+	if err != nil && ok {
+		log.Printf("Could not refresh the Google signing keys, using the cached ones: %v", err)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: sharedHTTPClient().Transport}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch %s: status %d", url, res.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signToken returns an RS256 token for claims signed by key as kid.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims oidcClaims) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCKeyRefreshFailureUsesCachedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var down atomic.Bool
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	v := newOIDCVerifier("https://notifier.example/push", "")
+	v.certsURL = server.URL
+	token := signToken(t, key, "key-1", oidcClaims{
+		Issuer:   "https://accounts.google.com",
+		Audience: "https://notifier.example/push",
+		Expiry:   time.Now().Add(time.Hour).Unix(),
+	})
+	if err := v.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// An hour later the keys are stale and the certs endpoint is down.
+	down.Store(true)
+	v.fetched = v.fetched.Add(-2 * time.Hour)
+	v.tried = v.tried.Add(-2 * time.Hour)
+	if err := v.Verify(token); err != nil {
+		t.Errorf("Verify with a failed refresh = %v, want the cached key used", err)
+	}
+	// The next refresh waits a minute rather than holding up every request.
+	if err := v.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Errorf("certs fetched %d times, want 2", got)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// opsgenieAPI is the Opsgenie API of the US region; EU accounts set the
+// channel URL to https://api.eu.opsgenie.com.
+const opsgenieAPI = "https://api.opsgenie.com"
+
+// opsgenieMaxLength is the longest alert description Opsgenie accepts.
+const opsgenieMaxLength = 15000
+
+// defaultOpsgeniePriorities maps failed build statuses to alert priorities.
+var defaultOpsgeniePriorities = map[string]string{
+	"FAILURE":        "P2",
+	"INTERNAL_ERROR": "P3",
+	"TIMEOUT":        "P3",
+}
+
+// OpsgenieNotifier raises an Opsgenie alert for failed builds and closes it
+// when a later build of the same trigger and branch succeeds. The trigger and
+// branch (failureKey) is the alert alias, so Opsgenie counts further failures
+// and redelivered messages on the open alert instead of opening another, and
+// any replica, or the notifier after a restart, can close it. Other statuses
+// are ignored; rules must route SUCCESS to the channel as well for alerts to
+// be closed.
+type OpsgenieNotifier struct {
+	APIURL     string
+	APIKey     string
+	Priorities map[string]string
+}
+
+// NewOpsgenieNotifier returns a notifier using OPSGENIE_API_KEY. An empty
+// apiURL means the US region API.
+func NewOpsgenieNotifier(apiURL string, priorities map[string]string) *OpsgenieNotifier {
+	if apiURL == "" {
+		apiURL = opsgenieAPI
+	}
+	if len(priorities) == 0 {
+		priorities = defaultOpsgeniePriorities
+	}
+	return &OpsgenieNotifier{
+		APIURL:     apiURL,
+		APIKey:     os.Getenv("OPSGENIE_API_KEY"),
+		Priorities: priorities,
+	}
+}
+
+func (n *OpsgenieNotifier) MaxLength() int {
+	return opsgenieMaxLength
+}
+
+func (n *OpsgenieNotifier) Notify(ctx context.Context, message string, data MessageData) error {
+	if data.Build == nil {
+		return nil
+	}
+	alias := failureKey(data.Build)
+	if data.Status == "SUCCESS" {
+		return n.closeAlert(ctx, alias)
+	}
+	priority, ok := n.Priorities[data.Status]
+	if !ok {
+		return nil
+	}
+	alert := map[string]interface{}{
+		"message":     truncateMessage(fmt.Sprintf("%s build %s on %s", data.Repo, data.Status, data.Branch), 130),
+		"alias":       alias,
+		"description": message,
+		"priority":    priority,
+		"source":      "cloudbuildnotifier",
+		"tags":        []string{"cloudbuild", data.Repo, data.Branch},
+		"details": map[string]string{
+			"build":  data.Build.ID,
+			"logs":   data.Build.LogURL,
+			"commit": data.Commit.HTML_URL,
+			"step":   data.FailureStep,
+		},
+	}
+	if err := n.post(ctx, "/v2/alerts", alert); err != nil {
+		return err
+	}
+	logf(ctx, "Opened Opsgenie alert %s for build %s", alias, data.Build.ID)
+	return nil
+}
+
+// closeAlert closes the open alert of alias, if there is one. Every SUCCESS
+// asks Opsgenie, which knows whether an alert is open.
+func (n *OpsgenieNotifier) closeAlert(ctx context.Context, alias string) error {
+	path := "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+	body := map[string]string{"source": "cloudbuildnotifier", "note": "A later build succeeded"}
+	err := n.post(ctx, path, body)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logf(ctx, "Closed Opsgenie alert %s", alias)
+	return nil
+}
+
+func (n *OpsgenieNotifier) post(ctx context.Context, path string, body interface{}) error {
+	if n.APIKey == "" {
+		return fmt.Errorf("%w: OPSGENIE_API_KEY is not set", ErrConfig)
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.APIURL+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "GenieKey "+n.APIKey)
+	res, err := sharedHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotifierUnavailable, err)
+	}
+	defer closeBody(res)
+	if res.StatusCode/100 != 2 {
+		return responseError("opsgenie", res, n.isRetryable)
+	}
+	return nil
+}
+
+// isRetryable retries rate limiting and server errors. Opsgenie reports a
+// rejected alert, e.g. a bad API key or payload, with a 4xx.
+func (n *OpsgenieNotifier) isRetryable(statusCode int, body []byte) bool {
+	return statusRetryable(statusCode)
+}
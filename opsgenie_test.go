@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOpsgenieClosesAlertByAlias(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	aliases := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.EscapedPath())
+		if r.URL.Path == "/v2/alerts" {
+			var alert map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&alert)
+			aliases[alert["alias"].(string)] = true
+		} else if r.URL.Query().Get("identifierType") != "alias" {
+			t.Errorf("close request %s does not identify the alert by alias", r.URL)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	t.Setenv("OPSGENIE_API_KEY", "test-key")
+	ctx := context.Background()
+
+	notify := func(n *OpsgenieNotifier, id, status string) {
+		t.Helper()
+		info := testBuild(t, "api", status, nil)
+		info.ID, info.BuildTriggerID = id, "trigger-1"
+		if err := n.Notify(ctx, "build "+status, MessageData{Build: info, Repo: "api", Branch: "main", Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := NewOpsgenieNotifier(server.URL, nil)
+	notify(n, "build-1", "FAILURE")
+	notify(n, "build-2", "FAILURE")
+	if len(aliases) != 1 || !aliases["trigger-1/main"] {
+		t.Errorf("alert aliases = %v, want one per trigger and branch", aliases)
+	}
+
+	// A restarted notifier still closes the alert.
+	notify(NewOpsgenieNotifier(server.URL, nil), "build-3", "SUCCESS")
+	if got, want := requests[len(requests)-1], "/v2/alerts/trigger-1%2Fmain/close"; got != want {
+		t.Errorf("last request = %s, want %s", got, want)
+	}
+}
+
+func TestOpsgenieCloseWithoutOpenAlert(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Alert does not exist"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+	t.Setenv("OPSGENIE_API_KEY", "test-key")
+
+	info := testBuild(t, "api", "SUCCESS", nil)
+	n := NewOpsgenieNotifier(server.URL, nil)
+	if err := n.Notify(context.Background(), "build SUCCESS", MessageData{Build: info, Status: "SUCCESS"}); err != nil {
+		t.Errorf("closing an alert that isn't open = %v, want nil", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Substitutions a build can set in its cloudbuild.yaml to override the rule
+// that matches it:
+//
+//	_NOTIFY=false          send no notification for the build
+//	_NOTIFY_CHANNEL=ops    send to these channels (comma separated) instead
+//	_NOTIFY_MENTION=@team  mention someone, as EscalationMention does
+const (
+	notifySubstitution        = "_NOTIFY"
+	notifyChannelSubstitution = "_NOTIFY_CHANNEL"
+	notifyMentionSubstitution = "_NOTIFY_MENTION"
+)
+
+// buildOverrides are the notification settings a build overrides.
+type buildOverrides struct {
+	suppress bool
+	channels []string
+	mention  string
+}
+
+// overridesFor reads the _NOTIFY substitutions of a build. Invalid values
+// are logged and ignored, so a typo never silences a build.
+func (p *Processor) overridesFor(info *CloudBuildInfo) buildOverrides {
+	var o buildOverrides
+	for key, value := range info.Substitutions.All {
+		if !strings.HasPrefix(key, notifySubstitution) {
+			continue
+		}
+		switch key {
+		case notifySubstitution:
+			notify, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Printf("Build %s: ignoring invalid %s=%q", info.ID, key, value)
+				continue
+			}
+			o.suppress = !notify
+		case notifyChannelSubstitution:
+			for _, name := range strings.Split(value, ",") {
+				name = strings.TrimSpace(name)
+				if _, ok := p.channels[name]; !ok {
+					log.Printf("Build %s: ignoring unknown channel %q in %s", info.ID, name, key)
+					continue
+				}
+				o.channels = append(o.channels, name)
+			}
+		case notifyMentionSubstitution:
+			o.mention = value
+		default:
+			log.Printf("Build %s: ignoring unknown substitution %s, expected %s, %s or %s",
+				info.ID, key, notifySubstitution, notifyChannelSubstitution, notifyMentionSubstitution)
+		}
+	}
+	return o
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Poller is the MODE=poll alternative to the pubsub receiver: it lists
+// recent builds from the Cloud Build API every interval and processes each
+// status it has not seen yet. Like the pull receiver's workers, at most
+// WORKER_COUNT builds are processed at once, each on its own, so a build
+// waiting out a rule Delay doesn't hold up the others.
+type Poller struct {
+	api       *CloudBuildClient
+	processor *Processor
+	interval  time.Duration
+	// since is the create time builds are listed from. It trails the oldest
+	// build still in progress so its final status is picked up.
+	since time.Time
+
+	mu sync.Mutex
+	// seen maps build ids to the last status processed.
+	seen map[string]polledBuild
+
+	workers chan struct{}
+	wg      sync.WaitGroup
+}
+
+type polledBuild struct {
+	status     string
+	createTime time.Time
+	// retry is set when processing asked for a redelivery, so the next poll
+	// processes the build again.
+	retry bool
+}
+
+func NewPoller(api *CloudBuildClient, processor *Processor, interval time.Duration) *Poller {
+	workers := getEnvInt("WORKER_COUNT", 10)
+	if workers < 1 {
+		workers = 1
+	}
+	return &Poller{
+		api:       api,
+		processor: processor,
+		interval:  interval,
+		since:     time.Now().Add(-interval),
+		seen:      make(map[string]polledBuild),
+		workers:   make(chan struct{}, workers),
+	}
+}
+
+// Run polls until ctx is done, then waits up to DRAIN_TIMEOUT for the builds
+// being processed.
+func (p *Poller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.poll(ctx); err != nil {
+			log.Printf("Got %s err while polling builds: %s\n", errorCategory(err), err)
+		}
+		select {
+		case <-ctx.Done():
+			if !waitTimeout(&p.wg, drainTimeout()) {
+				log.Printf("Builds still processing after DRAIN_TIMEOUT, they are processed again on the next start")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) error {
+	builds, err := p.api.ListBuilds(ctx, fmt.Sprintf("create_time>=%q", p.since.UTC().Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+	// Oldest first, so failure streaks are mostly recorded in order.
+	for i := len(builds) - 1; i >= 0; i-- {
+		var build CloudBuildInfo
+		if err := json.Unmarshal(builds[i], &build); err != nil {
+			log.Printf("Got %s err: %s\n", errorCategory(ErrInvalidPayload), err)
+			continue
+		}
+		p.mu.Lock()
+		prev, ok := p.seen[build.ID]
+		if ok && prev.status == build.Status && !prev.retry {
+			p.mu.Unlock()
+			continue
+		}
+		p.seen[build.ID] = polledBuild{status: build.Status, createTime: build.CreateTime}
+		p.mu.Unlock()
+		select {
+		case p.workers <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		p.wg.Add(1)
+		go p.process(builds[i], build)
+	}
+	p.advance()
+	return nil
+}
+
+// process processes a polled build. Builds being processed finish even once
+// polling stops.
+func (p *Poller) process(data []byte, build CloudBuildInfo) {
+	defer p.wg.Done()
+	defer func() { <-p.workers }()
+	// The attributes Cloud Build would set, so polled builds are filtered
+	// and deduplicated like pushed or pulled ones.
+	attrs := map[string]string{"buildId": build.ID, "status": build.Status}
+	err := p.processor.Process(context.Background(), data, attrs)
+	var redeliver *RedeliverError
+	if errors.As(err, &redeliver) {
+		p.mu.Lock()
+		p.seen[build.ID] = polledBuild{status: build.Status, createTime: build.CreateTime, retry: true}
+		p.mu.Unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("Got %s err: %s\n", errorCategory(err), err)
+	}
+}
+
+// advance moves since up to the oldest build still in progress or to be
+// retried, or the newest build seen, and forgets builds older than that.
+func (p *Poller) advance() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldestRunning, newest time.Time
+	for _, b := range p.seen {
+		if (contains(nonTerminalStatuses, b.status) || b.retry) && (oldestRunning.IsZero() || b.createTime.Before(oldestRunning)) {
+			oldestRunning = b.createTime
+		}
+		if b.createTime.After(newest) {
+			newest = b.createTime
+		}
+	}
+	switch {
+	case !oldestRunning.IsZero():
+		p.since = oldestRunning
+	case !newest.IsZero():
+		p.since = newest
+	}
+	for id, b := range p.seen {
+		if b.createTime.Before(p.since) {
+			delete(p.seen, id)
+		}
+	}
+}
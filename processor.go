@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Processor turns Cloud Build status messages into chat notifications.
+type Processor struct {
+	config   *Config
+	clock    Clock
+	failures *FailureTracker
+	channels map[string]*channel
+	// dryRun prints notifications to stdout instead of sending them, or
+	// records them in recorder when set.
+	dryRun   bool
+	recorder *RecordingNotifier
+	// offline skips the GitHub lookups, e.g. for snapshot tests.
+	offline bool
+	// prefix and suffix (MESSAGE_PREFIX, MESSAGE_SUFFIX) wrap every rendered
+	// message, e.g. to mark notifications from a staging instance.
+	prefix, suffix string
+	// redeliver is set when the receiver can redeliver a message, so a rate
+	// limited GitHub lookup is retried later instead of sent without commit
+	// details, at most GITHUB_MAX_REDELIVERIES times per build.
+	redeliver         bool
+	githubRedelivered *attemptCounter
+	// processed skips builds already notified for the same status within
+	// DEDUP_TTL.
+	processed *dedupCache
+	// ackPolicy (ACK_POLICY) decides whether partially delivered
+	// notifications are acked; see handled.
+	ackPolicy string
+	cooldowns *cooldownTracker
+	// builds tracks the newest build per trigger and branch for Superseded
+	// rules.
+	builds *buildTracker
+	// running holds the RunningAlert checks of WORKING builds.
+	running *runningTracker
+	// aggregates buffers notifications of AggregateWindow rules.
+	aggregates *aggregator
+	// firstDeploys tracks the first deploy of the day for FirstDeployOfDay
+	// rules.
+	firstDeploys *firstDeployTracker
+	// lookupPRs (GITHUB_LOOKUP_PRS) adds the commit's pull request to
+	// notifications, at the cost of a second GitHub API call per build.
+	lookupPRs bool
+	// correlationFooter (CORRELATION_FOOTER) adds the correlation id to
+	// notifications.
+	correlationFooter bool
+	// validatePayloads (VALIDATE_PAYLOADS) checks build messages against the
+	// bundled payload schema; see checkPayload.
+	validatePayloads bool
+	// notifyRetries (NOTIFY_RETRIES) is how many times a transient delivery
+	// failure is retried; see notifyWithRetry.
+	notifyRetries int
+	// delayed counts the notifications waiting out a rule Delay; beyond
+	// maxDelayed (MAX_DELAYED) they are sent right away.
+	delayed    atomic.Int64
+	maxDelayed int64
+	stats      *lifetimeStats
+	// history keeps the last BUILD_HISTORY processed builds for the admin
+	// server; nil when disabled.
+	history *BuildHistory
+}
+
+func NewProcessor(config *Config) *Processor {
+	return newProcessorWithClock(config, realClock{})
+}
+
+// newProcessorWithClock returns a processor whose time-dependent behaviour
+// follows clock, e.g. a fakeClock.
+func newProcessorWithClock(config *Config, clock Clock) *Processor {
+	return &Processor{
+		config:            config,
+		clock:             clock,
+		failures:          NewFailureTracker(),
+		channels:          newChannels(config),
+		prefix:            os.Getenv("MESSAGE_PREFIX"),
+		suffix:            os.Getenv("MESSAGE_SUFFIX"),
+		ackPolicy:         ackPolicy(),
+		cooldowns:         newCooldownTracker(clock),
+		lookupPRs:         os.Getenv("GITHUB_LOOKUP_PRS") == "true",
+		correlationFooter: os.Getenv("CORRELATION_FOOTER") == "true",
+		validatePayloads:  os.Getenv("VALIDATE_PAYLOADS") == "true",
+
+		githubRedelivered: newAttemptCounter(),
+		firstDeploys:      newFirstDeployTracker(),
+		builds:            newBuildTracker(),
+		running:           newRunningTracker(clock),
+		aggregates:        newAggregator(clock),
+		notifyRetries:     getEnvInt("NOTIFY_RETRIES", 2),
+		maxDelayed:        int64(getEnvInt("MAX_DELAYED", 1000)),
+		processed:         newDedupCache(clock, getEnvDuration("DEDUP_TTL", time.Hour)),
+		stats:             &lifetimeStats{started: clock.Now()},
+		history:           NewBuildHistory(getEnvInt("BUILD_HISTORY", 0)),
+	}
+}
+
+// Process handles a single Pub/Sub message payload and its attributes.
+// Cloud Build sets the "buildId" and "status" attributes, which are used to
+// drop uninteresting or duplicate messages before decoding the body.
+func (p *Processor) Process(ctx context.Context, data []byte, attrs map[string]string) error {
+	return p.process(ctx, data, attrs, false)
+}
+
+// Replay handles a build payload again, even if it was already notified.
+// The rule's Delay and deploy verification are skipped: the build finished
+// long ago, so the notification goes out right away.
+func (p *Processor) Replay(ctx context.Context, data []byte) error {
+	return p.process(ctx, data, nil, true)
+}
+
+func (p *Processor) process(ctx context.Context, data []byte, attrs map[string]string, replay bool) error {
+	buildID, status := attrs["buildId"], attrs["status"]
+	if buildID != "" {
+		ctx = withCorrelation(ctx, buildID)
+	}
+	if status != "" && !p.config.wantsStatus(status) {
+		return nil
+	}
+	if buildID != "" && status != "" && p.processed.Seen(dedupKey(buildID, status)) {
+		slog.DebugContext(ctx, "Skipping duplicate build message", "build", buildID, "status", status)
+		return nil
+	}
+	var cloudBuildInfo CloudBuildInfo
+	if err := json.Unmarshal(data, &cloudBuildInfo); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if correlationID(ctx) == "" {
+		id := cloudBuildInfo.ID
+		if id == "" {
+			id = newCorrelationID()
+		}
+		ctx = withCorrelation(ctx, id)
+	}
+	buildErr := cloudBuildInfo.checkBuild()
+	if p.validatePayloads && buildErr == nil {
+		for _, problem := range checkPayload(data) {
+			slog.WarnContext(ctx, "Build message does not match the payload schema", "build", cloudBuildInfo.ID, "field", problem.Field, "problem", problem.Problem)
+			payloadSchemaMismatches.Inc(problem.Field)
+		}
+	}
+	if buildErr != nil {
+		// Not a build, e.g. from a misconfigured topic: ack it and move on.
+		logf(ctx, "Skipping message that is not a Cloud Build status, got %s err: %v: %s", errorCategory(buildErr), buildErr, truncateMessage(string(data), 500))
+		return nil
+	}
+	p.config.resolveIdentity(&cloudBuildInfo)
+	p.builds.see(&cloudBuildInfo)
+	if !contains(nonTerminalStatuses, cloudBuildInfo.Status) {
+		p.running.stop(cloudBuildInfo.ID)
+	}
+	if (buildID != "" && buildID != cloudBuildInfo.ID) || (status != "" && status != cloudBuildInfo.Status) {
+		logf(ctx, "Message attributes buildId=%s status=%s disagree with body id=%s status=%s, using the body",
+			buildID, status, cloudBuildInfo.ID, cloudBuildInfo.Status)
+	}
+	key := dedupKey(cloudBuildInfo.ID, cloudBuildInfo.Status)
+	claimed, err := p.processed.Claim(key, replay)
+	if err != nil {
+		return &RedeliverError{After: time.Minute, Err: err}
+	}
+	if !claimed {
+		slog.DebugContext(ctx, "Skipping duplicate build message", "build", cloudBuildInfo.ID, "status", cloudBuildInfo.Status)
+		return nil
+	}
+	if len(attrs) > 0 {
+		slog.DebugContext(ctx, "Build message attributes", "build", cloudBuildInfo.ID, "attributes", attrs)
+	}
+	outcome, err := p.handle(ctx, cloudBuildInfo, attrs, replay)
+	if p.history != nil {
+		p.history.Add(newBuildRecord(&cloudBuildInfo, outcome, err, p.clock.Now()))
+	}
+	p.processed.Release(key, err == nil)
+	p.stats.record(outcome, err)
+	logBuild(ctx, &cloudBuildInfo, outcome)
+	return err
+}
+
+// shortID returns the first 8 characters of a build id.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// Outcomes of handling a build, as shown in the build history.
+const (
+	outcomeNoRule         = "no matching rule"
+	outcomeSilent         = "silenced by rule or _NOTIFY"
+	outcomeIgnoredAuthor  = "ignored author"
+	outcomeExternalAuthor = "suppressed external author"
+	outcomeNotified       = "notified"
+	outcomeCooldown       = "held back by cooldown"
+	outcomeQuietHeld      = "held back for quiet hours"
+	outcomeQuietDropped   = "dropped in quiet hours"
+	outcomeFailed         = "failed"
+	outcomeQueueWithinSLA = "queued within SLA"
+	outcomeSuperseded     = "cancelled for a newer build"
+	outcomeAggregated     = "combined with the commit's other builds"
+	outcomeNoOp           = "no-op build"
+	outcomeRunningWatched = "watched for running long"
+	outcomeDigested       = "added to the pipeline digest"
+)
+
+// handle matches a decoded build against the rules and sends its
+// notification, returning what happened to it.
+func (p *Processor) handle(ctx context.Context, cloudBuildInfo CloudBuildInfo, attrs map[string]string, replay bool) (string, error) {
+	rule := p.config.Match(&cloudBuildInfo)
+	if rule == nil {
+		p.failures.Record(failureKey(&cloudBuildInfo), cloudBuildInfo.ID, cloudBuildInfo.Status)
+		return outcomeNoRule, nil
+	}
+	overrides := p.overridesFor(&cloudBuildInfo)
+	if rule.Silent || overrides.suppress {
+		p.failures.Record(failureKey(&cloudBuildInfo), cloudBuildInfo.ID, cloudBuildInfo.Status)
+		return outcomeSilent, nil
+	}
+	if cloudBuildInfo.Status == "WORKING" && rule.RunningAlert > 0 {
+		info, watchCtx := cloudBuildInfo, withCorrelation(context.Background(), correlationID(ctx))
+		p.running.watch(&info, time.Duration(rule.RunningAlert), func(running time.Duration) {
+			p.notifyRunning(watchCtx, rule, &info, running)
+		})
+	}
+	if cloudBuildInfo.Status == "WORKING" && rule.QueueSLA > 0 {
+		if queued := cloudBuildInfo.queueTime(); queued > time.Duration(rule.QueueSLA) {
+			return p.notifyQueued(ctx, rule, &cloudBuildInfo, queued)
+		}
+		if !rule.NotifyOnStart {
+			return outcomeQueueWithinSLA, nil
+		}
+	}
+	if cloudBuildInfo.Status == "WORKING" && rule.RunningAlert > 0 && !rule.NotifyOnStart {
+		return outcomeRunningWatched, nil
+	}
+	superseded := rule.Superseded != "" && cloudBuildInfo.Status == "CANCELLED" && p.builds.superseded(&cloudBuildInfo)
+	if superseded && rule.Superseded == supersededSuppress {
+		return outcomeSuperseded, nil
+	}
+	noOp := rule.NoOp != "" && cloudBuildInfo.Status == "SUCCESS" && rule.noOp(cloudBuildInfo.Substitutions)
+	if noOp && rule.NoOp == noOpSuppress {
+		p.failures.Record(failureKey(&cloudBuildInfo), cloudBuildInfo.ID, cloudBuildInfo.Status)
+		return outcomeNoOp, nil
+	}
+	failureStep := failedStep(cloudBuildInfo.Steps)
+	var githubData GithubInfo
+	var err error
+	if sha := cloudBuildInfo.Substitutions.COMMITSHA; !validSHA(sha) {
+		slog.DebugContext(ctx, "Skipping GitHub lookup for build without a valid commit SHA", "build", cloudBuildInfo.ID, "sha", sha)
+	} else if !p.offline {
+		githubData, err = GetGithubInfo(ctx, cloudBuildInfo.Substitutions.COMMITSHA, cloudBuildInfo.Substitutions.REPONAME)
+	}
+	redeliveryKey := cloudBuildInfo.ID + "/" + cloudBuildInfo.Status
+	if errors.Is(err, ErrGitHubRateLimited) && p.redeliver &&
+		p.githubRedelivered.next(redeliveryKey) <= getEnvInt("GITHUB_MAX_REDELIVERIES", 3) {
+		redeliver := &RedeliverError{After: time.Minute, Err: err}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			redeliver.After = statusErr.RetryAfter
+		}
+		return outcomeFailed, redeliver
+	}
+	p.githubRedelivered.forget(redeliveryKey)
+	if errors.Is(err, ErrGitHubNotFound) {
+		logf(ctx, "Commit %s not found in %s, sending without commit details", cloudBuildInfo.Substitutions.COMMITSHA, cloudBuildInfo.Substitutions.REPONAME)
+	} else if err != nil {
+		logf(ctx, "%v", err)
+	}
+	if p.config.CommitURLTemplate != "" && cloudBuildInfo.Substitutions.COMMITSHA != "" {
+		if url, err := p.config.commitURL(&cloudBuildInfo); err != nil {
+			logf(ctx, "Could not render the commit URL: %v", err)
+		} else {
+			githubData.HTML_URL = url
+		}
+	}
+	failures, previous := p.failures.Record(failureKey(&cloudBuildInfo), cloudBuildInfo.ID, cloudBuildInfo.Status)
+	if p.config.ignoresAuthor(githubData.Author) {
+		slog.DebugContext(ctx, "Suppressed notification for ignored author",
+			"repo", cloudBuildInfo.Substitutions.REPONAME, "build", cloudBuildInfo.ID,
+			"author", githubData.Author.Name, "email", githubData.Author.Email)
+		return outcomeIgnoredAuthor, nil
+	}
+	external := p.config.externalAuthor(githubData)
+	if external && rule.SuppressExternal {
+		slog.DebugContext(ctx, "Suppressed notification for external author",
+			"repo", cloudBuildInfo.Substitutions.REPONAME, "build", cloudBuildInfo.ID,
+			"author", githubData.Author.Name, "login", githubData.AuthorLogin)
+		return outcomeExternalAuthor, nil
+	}
+	msgData := MessageData{
+		Repo:                cloudBuildInfo.Substitutions.REPONAME,
+		Branch:              cloudBuildInfo.Substitutions.BRANCHNAME,
+		Tag:                 cloudBuildInfo.Substitutions.TAGNAME,
+		Status:              cloudBuildInfo.Status,
+		FailureStep:         failureStep,
+		BuildType:           rule.BuildType,
+		BuildId:             cloudBuildInfo.ID,
+		ShortBuildId:        shortID(cloudBuildInfo.ID),
+		ProjectId:           cloudBuildInfo.ProjectID,
+		Commit:              githubData,
+		ShortSha:            shortSHA(cloudBuildInfo.Substitutions.COMMITSHA),
+		ConsecutiveFailures: failures,
+		Build:               &cloudBuildInfo,
+		Extra:               p.config.Extra,
+		Identity:            p.config.CommitIdentity,
+		FilesChanged:        githubData.ChangedFiles,
+		FilesChangedCapped:  githubData.ChangedFilesCapped,
+		LinesChanged:        githubData.Stats.Total,
+		ExternalAuthor:      external,
+		Attributes:          attrs,
+		CorrelationId:       correlationID(ctx),
+		statusTexts:         p.config.StatusTexts,
+	}
+	if fi := cloudBuildInfo.FailureInfo; fi != nil {
+		msgData.FailureType, msgData.FailureDetail = fi.Type, fi.Detail
+	}
+	if category := p.config.failureCategory(&cloudBuildInfo, failureStep); category != nil {
+		msgData.FailureCategory, msgData.Runbook = category.Name, category.Runbook
+	}
+	if rule.MentionAuthor && contains(failureStatuses, cloudBuildInfo.Status) {
+		msgData.Mention = p.config.authorMention(githubData)
+	}
+	if rule.largeChange(msgData.FilesChanged, msgData.LinesChanged) {
+		msgData.LargeChange = true
+		msgData.Mention = rule.LargeChangeMention
+	}
+	if githubData.PullRequest != nil {
+		msgData.PullRequest = githubData.PullRequest
+	} else if p.lookupPRs && githubData.SHA != "" && os.Getenv("GITHUB_COMMIT_ENDPOINT") != "graphql" {
+		pr, err := GetGithubPullRequest(ctx, cloudBuildInfo.Substitutions.COMMITSHA, cloudBuildInfo.Substitutions.REPONAME)
+		if err != nil {
+			logf(ctx, "Could not look up the pull request for %s: %v", cloudBuildInfo.Substitutions.COMMITSHA, err)
+		}
+		msgData.PullRequest = pr
+	}
+	if rule.ShowSlowestSteps && cloudBuildInfo.Status == "SUCCESS" {
+		msgData.SlowestSteps = slowestStepsTable(cloudBuildInfo.Steps, 3)
+	}
+	text, localized := rule.Template, rule.Templates
+	if rule.NotifyRecovery && cloudBuildInfo.Status == "SUCCESS" && previous > 0 {
+		msgData.RecoveredAfter = previous
+		text, localized = recoveredTemplate, nil
+		if rule.RecoveryTemplate != "" {
+			text = rule.RecoveryTemplate
+		}
+	}
+	internalError := cloudBuildInfo.Status == "INTERNAL_ERROR"
+	if rule.EscalationThreshold > 0 && failures >= rule.EscalationThreshold && !internalError {
+		if rule.EscalationTemplate != "" {
+			text, localized = rule.EscalationTemplate, nil
+		}
+		msgData.Mention = rule.EscalationMention
+	}
+	if superseded {
+		text, localized = supersededTemplate, nil
+		msgData.Mention = ""
+	}
+	if noOp {
+		text, localized = noOpTemplate, nil
+		msgData.NoOp, msgData.Mention = true, ""
+	}
+	if internalError {
+		text, localized = internalErrorTemplate, nil
+		if rule.InternalErrorTemplate != "" {
+			text = rule.InternalErrorTemplate
+		}
+		msgData.Mention = rule.InternalErrorMention
+	}
+	if rule.ShowSubstitutions && contains(failureStatuses, cloudBuildInfo.Status) {
+		if msgData.Substitutions = p.config.customSubstitutions(cloudBuildInfo.Substitutions); msgData.Substitutions != "" {
+			text, localized = decorate(text, localized, "", substitutionsBlock)
+		}
+	}
+	if msgData.Runbook != "" {
+		text, localized = decorate(text, localized, "", runbookLine)
+	}
+	if p.correlationFooter {
+		text, localized = decorate(text, localized, "", correlationLine)
+	}
+	if overrides.mention != "" {
+		msgData.Mention = overrides.mention
+	}
+	channels := rule.channelsFor(&cloudBuildInfo)
+	if external && len(rule.ExternalChannels) > 0 {
+		channels = rule.ExternalChannels
+	}
+	if internalError && len(rule.InternalErrorChannels) > 0 {
+		channels = rule.InternalErrorChannels
+	}
+	if len(overrides.channels) > 0 {
+		channels = overrides.channels
+	}
+	if rule.FirstDeployOfDay && cloudBuildInfo.Status == "SUCCESS" && p.firstDeploys.first(failureKey(&cloudBuildInfo), p.clock.Now(), p.config.loc) {
+		msgData.FirstDeployToday = true
+		text, localized = decorate(text, localized, firstDeployMarker, "")
+		channels = append([]string{}, channels...)
+		for _, name := range rule.FirstDeployChannels {
+			if !contains(channels, name) {
+				channels = append(channels, name)
+			}
+		}
+	}
+	if d := rule.Digest; d != nil {
+		if run := cloudBuildInfo.Substitutions.Get(d.Substitution); run != "" {
+			p.aggregates.add("digest:"+d.Substitution+"="+run, msgData.Repo, d.timeout(), d.Expected, rule.ChannelStrategy, channels, msgData, func(g *aggregateGroup) {
+				p.sendDigest(d, run, g)
+			})
+			return outcomeDigested, nil
+		}
+	}
+	if rule.Cooldown > 0 && !p.cooldowns.allow(failureKey(&cloudBuildInfo), time.Duration(rule.Cooldown), channels, msgData, p.sendCooldownSummary) {
+		slog.DebugContext(ctx, "Held back notification during cooldown", "repo", cloudBuildInfo.Substitutions.REPONAME, "build", cloudBuildInfo.ID)
+		return outcomeCooldown, nil
+	}
+	// Only successful deploys need time to roll out; failures are never held.
+	if rule.Delay > 0 && cloudBuildInfo.Status == "SUCCESS" && !p.dryRun && !replay {
+		p.wait(ctx, time.Duration(rule.Delay), cloudBuildInfo.ID)
+	}
+	if rule.Verify && cloudBuildInfo.Status == "SUCCESS" && !p.dryRun && !replay {
+		if err := verifyDeploy(ctx, rule.verifyURL()); err != nil {
+			logf(ctx, "Deploy of %s on %s did not verify: %v", cloudBuildInfo.Substitutions.REPONAME, cloudBuildInfo.Substitutions.BRANCHNAME, err)
+			msgData.VerifyError = err.Error()
+			text, localized = verifyFailedTemplate, nil
+			if rule.VerifyFailedTemplate != "" {
+				text = rule.VerifyFailedTemplate
+			}
+		}
+	}
+	if q := p.config.QuietHours; q != nil && !contains(failureStatuses, cloudBuildInfo.Status) {
+		if end, ok := q.until(p.clock.Now()); ok {
+			if q.Drop {
+				return outcomeQuietDropped, nil
+			}
+			p.hold(end, rule.ChannelStrategy, channels, msgData)
+			return outcomeQuietHeld, nil
+		}
+	}
+	if sha := cloudBuildInfo.Substitutions.COMMITSHA; rule.AggregateWindow > 0 && sha != "" {
+		key := cloudBuildInfo.Substitutions.REPONAME + "@" + sha
+		p.aggregates.add(key, aggregateName(msgData), time.Duration(rule.AggregateWindow), 0, rule.ChannelStrategy, channels, msgData, p.sendAggregate)
+		return outcomeAggregated, nil
+	}
+	if _, err := p.dispatchWith(ctx, rule.ChannelStrategy, channels, text, localized, msgData); err != nil {
+		return outcomeFailed, err
+	}
+	repo, branch := p.config.metricLabels(&cloudBuildInfo)
+	notificationsSent.Inc(repo, branch, cloudBuildInfo.Status)
+	return outcomeNotified, nil
+}
+
+// wait holds a notification back for a rule Delay, unless MAX_DELAYED
+// notifications are already waiting, in which case it is sent right away.
+func (p *Processor) wait(ctx context.Context, delay time.Duration, buildID string) {
+	if n := p.delayed.Add(1); n > p.maxDelayed {
+		p.delayed.Add(-1)
+		logf(ctx, "Sending build %s without its %s delay: %d notifications are already delayed (MAX_DELAYED)", buildID, delay, n-1)
+		return
+	}
+	defer p.delayed.Add(-1)
+	<-p.clock.After(delay)
+}
+
+// notifyQueued alerts that a build waited longer than its rule's QueueSLA
+// to start. It is sent without commit details, which don't explain it.
+func (p *Processor) notifyQueued(ctx context.Context, rule *Rule, info *CloudBuildInfo, queued time.Duration) (string, error) {
+	text := queueSLATemplate
+	if rule.QueueSLATemplate != "" {
+		text = rule.QueueSLATemplate
+	}
+	data := MessageData{
+		Repo:         info.Substitutions.REPONAME,
+		Branch:       info.Substitutions.BRANCHNAME,
+		Tag:          info.Substitutions.TAGNAME,
+		Status:       info.Status,
+		BuildType:    rule.BuildType,
+		BuildId:      info.ID,
+		ShortBuildId: shortID(info.ID),
+		ProjectId:    info.ProjectID,
+		Build:        info,
+		Extra:        p.config.Extra,
+		QueueTime:    queued.Round(time.Second),
+		statusTexts:  p.config.StatusTexts,
+	}
+	if _, err := p.dispatchWith(ctx, rule.ChannelStrategy, rule.channelsFor(info), text, nil, data); err != nil {
+		return outcomeFailed, err
+	}
+	return outcomeNotified, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureNotifier keeps the messages sent to it.
+type captureNotifier struct {
+	mu       sync.Mutex
+	messages []MessageData
+	texts    []string
+}
+
+func (n *captureNotifier) Notify(ctx context.Context, message string, data MessageData) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, data)
+	n.texts = append(n.texts, message)
+	return nil
+}
+
+func (n *captureNotifier) sent() []MessageData {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]MessageData(nil), n.messages...)
+}
+
+func (n *captureNotifier) sentTexts() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.texts...)
+}
+
+// newCaptureProcessor returns a processor sending the channel "team" to a
+// captureNotifier, with GitHub lookups answered 404.
+func newCaptureProcessor(t *testing.T, config *Config) (*Processor, *captureNotifier) {
+	t.Helper()
+	return newCaptureProcessorWithClock(t, config, realClock{})
+}
+
+// newCaptureProcessorWithClock is newCaptureProcessor following clock.
+func newCaptureProcessorWithClock(t *testing.T, config *Config, clock Clock) (*Processor, *captureNotifier) {
+	t.Helper()
+	useGithubAPI(t, http.NotFound)
+	p := newProcessorWithClock(config, clock)
+	n := &captureNotifier{}
+	p.channels = map[string]*channel{"team": {name: "team", notifier: n, timeout: time.Second}}
+	return p, n
+}
+
+// buildPayload is a minimal Cloud Build message for repo and branch.
+func buildPayload(id, status, repo, branch string) []byte {
+	return []byte(`{"id":"` + id + `","projectId":"proj","status":"` + status + `",` +
+		`"logUrl":"https://console.cloud.google.com/cloud-build/builds/` + id + `",` +
+		`"substitutions":{"REPO_NAME":"` + repo + `","BRANCH_NAME":"` + branch + `","COMMIT_SHA":"0123456789abcdef0123456789abcdef01234567"}}`)
+}
+
+// teamConfig routes SUCCESS and FAILURE builds of repo api on main to the
+// channel "team".
+const teamConfig = `{
+	"channels": {"team": {"type": "hangout", "url": "https://chat.googleapis.com/v1/spaces/team/messages"}},
+	"rules": [{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS", "FAILURE"], "template": "{{.Status}}", "channels": ["team"]}]
+}`
+
+func TestProcessUsesPubSubAttributes(t *testing.T) {
+	p, n := newCaptureProcessor(t, testConfig(t, teamConfig))
+	ctx := context.Background()
+	// What Cloud Build publishes to the cloud-builds topic, besides the body.
+	attrs := func(id, status string) map[string]string {
+		return map[string]string{"buildId": id, "status": status}
+	}
+	garbage := []byte("not a build")
+
+	// A status no rule wants is dropped before the body is decoded.
+	if err := p.Process(ctx, garbage, attrs("build-1", "WORKING")); err != nil {
+		t.Errorf("WORKING message = %v, want it dropped", err)
+	}
+
+	if err := p.Process(ctx, buildPayload("build-1", "SUCCESS", "api", "main"), attrs("build-1", "SUCCESS")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(n.sent()); got != 1 {
+		t.Fatalf("%d messages for the SUCCESS build, want 1", got)
+	}
+
+	// A redelivery is skipped on its attributes, before the body is decoded.
+	if err := p.Process(ctx, garbage, attrs("build-1", "SUCCESS")); err != nil {
+		t.Errorf("redelivered message = %v, want it skipped", err)
+	}
+	if got := len(n.sent()); got != 1 {
+		t.Errorf("%d messages after a redelivery, want 1", got)
+	}
+
+	// When the attributes disagree with the body, the body wins.
+	if err := p.Process(ctx, buildPayload("build-2", "SUCCESS", "api", "main"), attrs("build-2", "FAILURE")); err != nil {
+		t.Fatal(err)
+	}
+	sent := n.sent()
+	if len(sent) != 2 || sent[1].Build.ID != "build-2" || sent[1].Status != "SUCCESS" {
+		t.Errorf("message for build-2 = %+v, want its body's SUCCESS", sent[len(sent)-1])
+	}
+}
+
+// delayConfig is teamConfig with a 5m delay.
+const delayConfig = `{
+	"channels": {"team": {"type": "hangout", "url": "https://chat.googleapis.com/v1/spaces/team/messages"}},
+	"rules": [{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS", "FAILURE"], "template": "{{.Status}}", "channels": ["team"], "delay": "5m"}]
+}`
+
+// waitUntil polls cond for up to a second.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessSkipsInFlightDuplicates(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	p, n := newCaptureProcessorWithClock(t, testConfig(t, delayConfig), clock)
+	ctx := context.Background()
+	payload := buildPayload("build-1", "SUCCESS", "api", "main")
+	attrs := map[string]string{"buildId": "build-1", "status": "SUCCESS"}
+
+	done := make(chan error, 1)
+	go func() { done <- p.Process(ctx, payload, attrs) }()
+	waitUntil(t, "the build waits for its delay", func() bool { return clock.pending() == 1 })
+
+	// Pub/Sub redelivers the message while the first copy is still waiting.
+	if err := p.Process(ctx, payload, attrs); err != nil {
+		t.Errorf("in-flight duplicate = %v, want it skipped", err)
+	}
+	clock.Advance(5 * time.Minute)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// And once more after it was processed.
+	if err := p.Process(ctx, payload, attrs); err != nil {
+		t.Errorf("processed duplicate = %v, want it skipped", err)
+	}
+	if got := len(n.sent()); got != 1 {
+		t.Errorf("build processed 3 times sent %d messages, want 1", got)
+	}
+}
+
+func TestInternalErrorIsNotAFailure(t *testing.T) {
+	p, team := newCaptureProcessor(t, testConfig(t, `{
+		"channels": {
+			"team": {"type": "hangout", "url": "https://chat.googleapis.com/v1/spaces/team/messages"},
+			"infra": {"type": "hangout", "url": "https://chat.googleapis.com/v1/spaces/infra/messages"}
+		},
+		"rules": [{"repo_name": "api", "branches": ["main"], "channels": ["team"],
+			"statuses": ["FAILURE", "INTERNAL_ERROR"], "template": "{{.Status}}",
+			"escalation_threshold": 2, "escalation_mention": "@oncall",
+			"internal_error_channels": ["infra"]}]
+	}`))
+	infra := &captureNotifier{}
+	p.channels["infra"] = &channel{name: "infra", notifier: infra, timeout: time.Second}
+	ctx := context.Background()
+	for _, build := range [][]byte{
+		buildPayload("build-1", "FAILURE", "api", "main"),
+		buildPayload("build-2", "INTERNAL_ERROR", "api", "main"),
+	} {
+		if err := p.Process(ctx, build, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(team.sent()); got != 1 {
+		t.Errorf("team got %d messages, want only the FAILURE", got)
+	}
+	texts, sent := infra.sentTexts(), infra.sent()
+	if len(sent) != 1 {
+		t.Fatalf("infra got %d messages, want the INTERNAL_ERROR", len(sent))
+	}
+	if !strings.Contains(texts[0], "internal error") || strings.Contains(texts[0], "@oncall") {
+		t.Errorf("INTERNAL_ERROR message = %q, want the internal error template without escalation", texts[0])
+	}
+	if sent[0].ConsecutiveFailures > 1 {
+		t.Errorf("INTERNAL_ERROR counted as failure %d in a row", sent[0].ConsecutiveFailures)
+	}
+
+	// The next failure is the second in a row, not the third.
+	if err := p.Process(ctx, buildPayload("build-3", "FAILURE", "api", "main"), nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs := team.sent()
+	if last := msgs[len(msgs)-1]; last.ConsecutiveFailures != 2 {
+		t.Errorf("next FAILURE is failure %d in a row, want 2", last.ConsecutiveFailures)
+	}
+}
+
+func TestFailuresAreNotDelayed(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	p, n := newCaptureProcessorWithClock(t, testConfig(t, delayConfig), clock)
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() { done <- p.Process(ctx, buildPayload("build-1", "FAILURE", "api", "main"), nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		clock.Advance(5 * time.Minute)
+		t.Fatal("FAILURE notification waited for the rule's delay")
+	}
+	if got := len(n.sent()); got != 1 {
+		t.Fatalf("%d messages for the failure, want 1", got)
+	}
+
+	// A success of the same rule is held back for the delay.
+	go func() { done <- p.Process(ctx, buildPayload("build-2", "SUCCESS", "api", "main"), nil) }()
+	waitUntil(t, "the success waits for its delay", func() bool { return clock.pending() == 1 })
+	if got := len(n.sent()); got != 1 {
+		t.Errorf("%d messages before the delay ended, want 1", got)
+	}
+	clock.Advance(5 * time.Minute)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := len(n.sent()); got != 2 {
+		t.Errorf("%d messages after the delay, want 2", got)
+	}
+}
+
+func TestBuildWithoutCommitSHA(t *testing.T) {
+	p, n := newCaptureProcessor(t, testConfig(t, `{
+		"channels": {"team": {"type": "hangout", "url": "https://chat.googleapis.com/v1/spaces/team/messages"}},
+		"rules": [{"repo_name": "api", "branches": ["main"], "statuses": ["SUCCESS"], "channels": ["team"]}]
+	}`))
+	lookups := 0
+	useGithubAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		http.NotFound(w, r)
+	})
+	payload := []byte(`{"id": "build-1", "status": "SUCCESS", "substitutions": {"REPO_NAME": "api", "BRANCH_NAME": "main", "COMMIT_SHA": ""}}`)
+	if err := p.Process(context.Background(), payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 0 {
+		t.Errorf("build without a commit SHA made %d GitHub requests, want none", lookups)
+	}
+	texts := n.sentTexts()
+	if len(texts) != 1 {
+		t.Fatalf("%d messages for the build without a commit SHA, want 1", len(texts))
+	}
+	for _, line := range []string{"Commit message:", "Commit Url:", "Author:", "Committer:"} {
+		if strings.Contains(texts[0], line) {
+			t.Errorf("message %q has a %q line without a commit", texts[0], line)
+		}
+	}
+}
+
+func TestValidSHA(t *testing.T) {
+	tests := []struct {
+		sha  string
+		want bool
+	}{
+		{"", false},
+		{"abc12", false},
+		{"abc1234", true},
+		{"0123456789abcdef0123456789abcdef01234567", true},
+		{"$COMMIT_SHA", false},
+		{"main", false},
+	}
+	for _, tt := range tests {
+		if got := validSHA(tt.sha); got != tt.want {
+			t.Errorf("validSHA(%q) = %v, want %v", tt.sha, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		valid   bool
+	}{
+		{"branch build", `{"id": "b", "status": "SUCCESS", "substitutions": {"REPO_NAME": "api", "BRANCH_NAME": "main"}}`, true},
+		{"tag build", `{"id": "b", "status": "SUCCESS", "substitutions": {"REPO_NAME": "api", "TAG_NAME": "v1.0.0"}}`, true},
+		{"no id", `{"status": "SUCCESS", "substitutions": {"REPO_NAME": "api", "BRANCH_NAME": "main"}}`, false},
+		{"no substitutions", `{"id": "b", "status": "SUCCESS"}`, false},
+		{"no repo", `{"id": "b", "status": "SUCCESS", "substitutions": {"BRANCH_NAME": "main"}}`, false},
+		{"no branch or tag", `{"id": "b", "status": "SUCCESS", "substitutions": {"REPO_NAME": "api"}}`, false},
+	}
+	for _, tt := range tests {
+		var build CloudBuildInfo
+		if err := json.Unmarshal([]byte(tt.payload), &build); err != nil {
+			t.Fatal(err)
+		}
+		err := build.checkBuild()
+		if tt.valid && err != nil {
+			t.Errorf("%s: checkBuild = %v, want nil", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: checkBuild = %v, want ErrInvalidPayload", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pushEnvelope is the body Pub/Sub POSTs to a push endpoint.
+type pushEnvelope struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		// Data is base64 in the envelope; encoding/json decodes it for []byte.
+		Data      []byte `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+	// DeliveryAttempt is only set when the subscription has a dead letter
+	// policy.
+	DeliveryAttempt *int `json:"deliveryAttempt"`
+}
+
+// maxPushAckDeadline is the longest acknowledgement deadline a push
+// subscription can have.
+const maxPushAckDeadline = 10 * time.Minute
+
+// servePush runs the notifier as a Pub/Sub push endpoint, e.g. on Cloud Run.
+// PUSH_AUDIENCE is the audience configured on the push subscription and
+// PUSH_SERVICE_ACCOUNT, when set, the service account it authenticates as.
+func servePush(ctx context.Context, processor *Processor, deadLetter DeadLetter) error {
+	audience := os.Getenv("PUSH_AUDIENCE")
+	if audience == "" {
+		return fmt.Errorf("%w: PUSH_AUDIENCE is required in push mode", ErrConfig)
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	if d := processor.config.longestDelay(); d > maxPushAckDeadline {
+		log.Printf("Rule delays of up to %s exceed the longest push acknowledgement deadline, %s; Pub/Sub will redeliver those builds while they wait", d, maxPushAckDeadline)
+	}
+	verifier := newOIDCVerifier(audience, os.Getenv("PUSH_SERVICE_ACCOUNT"))
+	w := &puller{
+		processor:   processor,
+		deadLetter:  deadLetter,
+		maxAttempts: getEnvInt("MAX_PROCESSING_ATTEMPTS", 0),
+		deliveries:  newAttemptCounter(),
+	}
+	// inFlight tracks the pushes being processed, which can outlive a
+	// Shutdown that timed out.
+	var inFlight sync.WaitGroup
+	mux := http.NewServeMux()
+	mux.Handle("/pubsub/push", pushHandler(verifier, w, &inFlight))
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	drained := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// Stop accepting pushes and let the ones in flight finish.
+		deadline := time.Now().Add(drainTimeout())
+		shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		if !waitTimeout(&inFlight, time.Until(deadline)) {
+			log.Printf("Push requests still in flight after DRAIN_TIMEOUT, Pub/Sub will redeliver them")
+		}
+		close(drained)
+	}()
+	log.Printf("Listening for pubsub push messages on :%s/pubsub/push", port)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-drained
+	return nil
+}
+
+// pushHandler verifies and decodes a push request and processes the message
+// within the request, so it works with CPU allocated only during requests on
+// Cloud Run. Messages are settled as in pull mode: a 204 acks the message
+// and a 503 has Pub/Sub redeliver it, with the backoff of the subscription's
+// retry policy rather than a RedeliverError's. The subscription's
+// acknowledgement deadline has to cover the longest rule delay.
+func pushHandler(verifier *oidcVerifier, w *puller, inFlight *sync.WaitGroup) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		received := time.Now()
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := verifier.Verify(token); err != nil {
+			log.Printf("Rejected pubsub push request: %v", err)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			messagesTotal.Inc("nacked")
+			return
+		}
+		var envelope pushEnvelope
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			// Redelivering a malformed envelope would fail the same way.
+			log.Printf("Got %s err: %s\n", errorCategory(ErrInvalidPayload), err)
+			rw.WriteHeader(http.StatusNoContent)
+			messagesTotal.Inc("acked")
+			return
+		}
+		msg := &pubsub.Message{
+			ID:              envelope.Message.MessageID,
+			Data:            envelope.Message.Data,
+			Attributes:      envelope.Message.Attributes,
+			DeliveryAttempt: envelope.DeliveryAttempt,
+		}
+		ack, redeliver := w.process(r.Context(), msg)
+		processingDuration.Observe(time.Since(received).Seconds())
+		if redeliver != nil {
+			log.Printf("Redelivering message %s: %v", msg.ID, redeliver.Err)
+		}
+		if !ack {
+			http.Error(rw, "redeliver", http.StatusServiceUnavailable)
+			messagesTotal.Inc("nacked")
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		messagesTotal.Inc("acked")
+	})
+}
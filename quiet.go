@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// failureStatuses are the build statuses that always notify straight away.
+var failureStatuses = []string{"FAILURE", "INTERNAL_ERROR", "TIMEOUT"}
+
+// QuietHours holds back notifications other than failures between Start and
+// End ("19:00", "08:00") local time in Timezone, on the listed Days (every
+// day when empty). A range that ends before it starts runs past midnight and
+// belongs to the day it starts on; equal Start and End cover the whole day.
+// Held back notifications are sent when quiet hours end, or dropped with Drop.
+type QuietHours struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone"`
+	Days     []string `json:"days"`
+	Drop     bool     `json:"drop"`
+
+	loc        *time.Location
+	start, end time.Duration
+	days       map[time.Weekday]bool
+}
+
+func (q *QuietHours) compile() error {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return err
+	}
+	q.loc = loc
+	if q.start, err = parseClock(q.Start); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	if q.end, err = parseClock(q.End); err != nil {
+		return fmt.Errorf("end: %v", err)
+	}
+	q.days = make(map[time.Weekday]bool)
+	for _, name := range q.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", name)
+		}
+		q.days[day] = true
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock parses "15:04" into the time since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// until reports whether now falls in quiet hours and, if so, when they end.
+// The range is built from wall clock times with time.Date, so it keeps its
+// local start and end across DST changes.
+func (q *QuietHours) until(now time.Time) (time.Time, bool) {
+	local := now.In(q.loc)
+	// A range that started yesterday may still be running.
+	for _, day := range []time.Time{local.AddDate(0, 0, -1), local} {
+		if len(q.days) > 0 && !q.days[day.Weekday()] {
+			continue
+		}
+		start := q.at(day, q.start)
+		end := q.at(day, q.end)
+		if !end.After(start) {
+			end = q.at(day.AddDate(0, 0, 1), q.end)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (q *QuietHours) at(day time.Time, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, q.loc)
+}
+
+// quietKeyPrefix starts the aggregator keys of the notifications held back
+// during quiet hours.
+const quietKeyPrefix = "quiet:"
+
+// hold buffers a notification until quiet hours end, when the ones held for
+// the same channels are sent as one message.
+func (p *Processor) hold(end time.Time, strategy string, channels []string, data MessageData) {
+	key := quietKeyPrefix + strategy + ":" + strings.Join(channels, ",")
+	p.aggregates.add(key, aggregateName(data), end.Sub(p.clock.Now()), 0, strategy, channels, data, p.sendQuietBatch)
+}
+
+// sendQuietBatch sends the notifications held back during quiet hours.
+func (p *Processor) sendQuietBatch(g *aggregateGroup) {
+	data := g.first
+	data.Builds, data.Mention = g.builds, ""
+	log.Printf("Quiet hours ended, sending %d held back notifications", len(g.builds))
+	if _, err := p.dispatchWith(context.Background(), g.strategy, g.channels, quietBatchTemplate, nil, data); err != nil {
+		log.Printf("Could not send the notifications held back during quiet hours: %v", err)
+	}
+}
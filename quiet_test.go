@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursSendOneBatch(t *testing.T) {
+	config, err := parseConfig([]byte(`{
+		"hangout_urls": {"team": "https://chat.googleapis.com/v1/spaces/team/messages"},
+		"quiet_hours": {"start": "19:00", "end": "08:00", "timezone": "UTC"},
+		"rules": [{"repo_name": "api", "branches": ["main"], "channels": ["team"]}]
+	}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, rec, clock := newTestProcessor(t, config)
+	clock.Advance(10 * time.Hour) // 22:00
+	ctx := context.Background()
+	for _, id := range []string{"build-1", "build-2"} {
+		if err := p.Process(ctx, buildPayload(id, "SUCCESS", "api", "main"), nil); err != nil {
+			t.Fatalf("Process(%s): %v", id, err)
+		}
+	}
+	if got := len(rec.Messages()); got != 0 {
+		t.Fatalf("%d messages sent during quiet hours, want 0", got)
+	}
+
+	clock.Advance(10 * time.Hour) // 08:00
+	deadline := time.Now().Add(time.Second)
+	for len(rec.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	messages := rec.MessagesForChannel("team")
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages after quiet hours, want 1", len(messages))
+	}
+	for _, id := range []string{"build-1", "build-2"} {
+		if !strings.Contains(messages[0].Message, id) {
+			t.Errorf("batch %q does not mention %s", messages[0].Message, id)
+		}
+	}
+}
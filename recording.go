@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RecordedMessage is a message a RecordingNotifier received.
+type RecordedMessage struct {
+	Channel string
+	Message string
+	Data    MessageData
+	Sent    time.Time
+}
+
+// RecordingNotifier keeps the messages sent to it in memory instead of
+// delivering them, to check template output and routing in tests. Install
+// it on a processor to record every channel:
+//
+//	rec := NewRecordingNotifier(clock)
+//	rec.Install(processor)
+//	processor.Process(ctx, payload, nil)
+//	rec.MessagesForChannel("alerts")
+type RecordingNotifier struct {
+	clock Clock
+
+	mu       sync.Mutex
+	messages []RecordedMessage
+}
+
+func NewRecordingNotifier(clock Clock) *RecordingNotifier {
+	return &RecordingNotifier{clock: clock}
+}
+
+// Install replaces the notifier of every channel of p with one recording
+// into r under the channel's name.
+func (r *RecordingNotifier) Install(p *Processor) {
+	for name, ch := range p.channels {
+		ch.notifier = r.Channel(name)
+	}
+}
+
+// Channel returns a Notifier recording into r under the channel name.
+func (r *RecordingNotifier) Channel(name string) Notifier {
+	return &recordingChannel{recorder: r, name: name}
+}
+
+// Messages returns the recorded messages in the order they were sent.
+func (r *RecordingNotifier) Messages() []RecordedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedMessage(nil), r.messages...)
+}
+
+// LastMessage returns the most recent message, if any was sent.
+func (r *RecordingNotifier) LastMessage() (RecordedMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.messages) == 0 {
+		return RecordedMessage{}, false
+	}
+	return r.messages[len(r.messages)-1], true
+}
+
+// MessagesForChannel returns the messages sent to the channel name.
+func (r *RecordingNotifier) MessagesForChannel(name string) []RecordedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []RecordedMessage
+	for _, m := range r.messages {
+		if m.Channel == name {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Reset forgets the recorded messages.
+func (r *RecordingNotifier) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = nil
+}
+
+type recordingChannel struct {
+	recorder *RecordingNotifier
+	name     string
+}
+
+func (c *recordingChannel) Notify(ctx context.Context, message string, data MessageData) error {
+	r := c.recorder
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, RecordedMessage{Channel: c.name, Message: message, Data: data, Sent: r.clock.Now()})
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redactedMarker replaces secret values in log output.
+const redactedMarker = "[REDACTED]"
+
+// secretSet holds the loaded secret values that must never reach the logs.
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+var secrets = &secretSet{}
+
+// add registers secret values. Very short values are skipped, as masking
+// them would mangle unrelated output.
+func (s *secretSet) add(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		if len(v) >= 8 && !contains(s.values, v) {
+			s.values = append(s.values, v)
+		}
+	}
+}
+
+// addWebhook registers the credentials embedded in a webhook URL: the key
+// and token query parameters of a Google Chat webhook, and any userinfo.
+func (s *secretSet) addWebhook(rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		s.add(rawURL)
+		return
+	}
+	query := u.Query()
+	s.add(query.Get("key"), query.Get("token"))
+	if password, ok := u.User.Password(); ok {
+		s.add(password)
+	}
+	// Query values are logged escaped when the whole URL is printed.
+	s.add(url.QueryEscape(query.Get("key")), url.QueryEscape(query.Get("token")))
+}
+
+func (s *secretSet) redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.values {
+		text = strings.Replace(text, v, redactedMarker, -1)
+	}
+	return text
+}
+
+// redactAttr is a slog ReplaceAttr function masking secrets in the message
+// and in string, error and Stringer attribute values, including those in
+// groups and in map[string]string values such as the message attributes.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(secrets.redact(a.Value.String()))
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redactAttr(append(groups[:len(groups):len(groups)], a.Key), attr)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case map[string]string:
+			redacted := make(map[string]string, len(v))
+			for k, value := range v {
+				redacted[k] = secrets.redact(value)
+			}
+			a.Value = slog.AnyValue(redacted)
+		case error, fmt.Stringer:
+			a.Value = slog.StringValue(secrets.redact(fmt.Sprint(v)))
+		}
+	}
+	return a
+}
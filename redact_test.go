@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactAttr(t *testing.T) {
+	const secret = "s3cr3t-webhook-token"
+	secrets.add(secret)
+
+	tests := []struct {
+		name string
+		attr slog.Attr
+	}{
+		{"string", slog.String("url", "https://chat.example/?token="+secret)},
+		{"error", slog.Any("err", errors.New("post "+secret+": timeout"))},
+		{"group", slog.Group("request", slog.String("url", "https://chat.example/?token="+secret))},
+		{"nested group", slog.Group("outer", slog.Group("inner", slog.Any("err", errors.New(secret))))},
+		{"map", slog.Any("attributes", map[string]string{"buildId": "build-1", "token": secret})},
+	}
+	for _, tt := range tests {
+		got := redactAttr(nil, tt.attr).Value.Resolve().String()
+		if strings.Contains(got, secret) || !strings.Contains(got, redactedMarker) {
+			t.Errorf("%s: redacted to %q", tt.name, got)
+		}
+	}
+
+	// Through a handler, as setupLogging installs it.
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+	logger.Info("Build message attributes", "attributes", map[string]string{"token": secret})
+	if strings.Contains(buf.String(), secret) {
+		t.Errorf("log line %q has the secret", buf.String())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal Redis client over a single connection, enough
+// for the few commands the shared stores use. The connection is opened on
+// first use and reopened after a network error.
+type redisClient struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	lastUsed time.Time
+}
+
+// redisIdleCheck is how long a connection may sit idle before it is checked
+// with a PING, so commands are not sent on a connection the server or a
+// load balancer already dropped.
+const redisIdleCheck = 30 * time.Second
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisClient parses redis://[user:password@]host[:port][/db], or
+// rediss:// for TLS.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: redis url does not parse", ErrConfig)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("%w: redis url must start with redis:// or rediss://", ErrConfig)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss", timeout: getEnvDuration("REDIS_TIMEOUT", 5*time.Second)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		secrets.add(c.password)
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("%w: redis database must be a number, got %q", ErrConfig, db)
+		}
+	}
+	return c, nil
+}
+
+// do runs a command and returns its reply: a string, an int64, nil or a
+// []interface{} of those.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands back to back on the connection, e.g. a MULTI ...
+// EXEC transaction, and returns their replies. After a network error the
+// server may or may not have run the commands, so they are sent once more
+// on a new connection only when that is safe; see retryable.
+func (c *redisClient) pipeline(cmds ...[]string) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && time.Since(c.lastUsed) > redisIdleCheck {
+		if _, err := c.roundTrip([]string{"PING"}); err != nil {
+			c.close()
+		}
+	}
+	replies, err := c.roundTrip(cmds...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.close()
+		if !retryable(cmds) {
+			return nil, err
+		}
+		replies, err = c.roundTrip(cmds...)
+		if err != nil && !errors.As(err, &redisErr) {
+			c.close()
+		}
+	}
+	return replies, err
+}
+
+// retryable reports whether running cmds twice has the same effect and
+// replies as running them once. Reads and overwrites qualify; INCR and
+// SET NX don't, nor does a DEL in the same pipeline as a read, whose reply
+// a retry would change.
+func retryable(cmds [][]string) bool {
+	reads, deletes := false, false
+	for _, args := range cmds {
+		switch strings.ToUpper(args[0]) {
+		case "MULTI", "EXEC", "PEXPIRE":
+		case "GET", "EXISTS", "PING":
+			reads = true
+		case "DEL":
+			deletes = true
+		case "SET":
+			for i := 3; i < len(args); i++ {
+				if opt := strings.ToUpper(args[i]); opt == "NX" || opt == "XX" || opt == "GET" {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return !(reads && deletes)
+}
+
+func (c *redisClient) roundTrip(cmds ...[]string) ([]interface{}, error) {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.lastUsed = time.Now()
+	for _, args := range cmds {
+		if err := writeRedisCommand(c.conn, args); err != nil {
+			return nil, err
+		}
+	}
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := readRedisReply(c.r)
+		var redisErr redisError
+		if err != nil && !errors.As(err, &redisErr) {
+			return nil, err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" && c.username != "" {
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	} else if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.roundTrip(setup...); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		// Errors in an array, e.g. of a failed command in a transaction,
+		// are returned as items so the rest of the reply is still read.
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readRedisReply(r)
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				items[i] = redisErr
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is an in-memory Redis server speaking enough RESP for the
+// commands the stores use. Expiry is ignored.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	data map[string]string
+	// dropAfter makes the server run the next command named so, then close
+	// the connection without replying, as if the network failed.
+	dropAfter string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{listener: l, data: make(map[string]string)}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) url() string {
+	return "redis://" + s.listener.Addr().String()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		name := strings.ToUpper(args[0])
+		s.mu.Lock()
+		drop := s.dropAfter == name
+		if drop {
+			s.dropAfter = ""
+		}
+		s.mu.Unlock()
+		var out string
+		switch {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			out = "+OK\r\n"
+		case name == "EXEC":
+			inMulti = false
+			out = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, cmd := range queued {
+				out += s.run(cmd)
+			}
+		case inMulti:
+			queued = append(queued, args)
+			out = "+QUEUED\r\n"
+		default:
+			out = s.run(args)
+		}
+		if drop {
+			return
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) run(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		_, exists := s.data[args[1]]
+		for _, opt := range args[3:] {
+			if strings.ToUpper(opt) == "NX" && exists {
+				return "$-1\r\n"
+			}
+		}
+		s.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "INCR":
+		n, err := strconv.Atoi(s.data[args[1]])
+		if _, exists := s.data[args[1]]; exists && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		s.data[args[1]] = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "PEXPIRE":
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (s *fakeRedis) get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+func (s *fakeRedis) dropReplyAfter(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropAfter = command
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		tls      bool
+		password string
+		db       int
+		wantErr  bool
+	}{
+		{url: "redis://localhost", addr: "localhost:6379"},
+		{url: "redis://10.0.0.3:6380/2", addr: "10.0.0.3:6380", db: 2},
+		{url: "rediss://:s3cret@redis.internal:6380", addr: "redis.internal:6380", tls: true, password: "s3cret"},
+		{url: "redis://localhost/cache", wantErr: true},
+		{url: "http://localhost:6379", wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := newRedisClient(tt.url)
+		if tt.wantErr {
+			if !errors.Is(err, ErrConfig) {
+				t.Errorf("newRedisClient(%q) error = %v, want ErrConfig", tt.url, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newRedisClient(%q): %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.tls != tt.tls || c.password != tt.password || c.db != tt.db {
+			t.Errorf("newRedisClient(%q) = addr %s tls %v password %q db %d", tt.url, c.addr, c.tls, c.password, c.db)
+		}
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+		err  error
+	}{
+		{raw: "+OK\r\n", want: "OK"},
+		{raw: ":42\r\n", want: int64(42)},
+		{raw: "$5\r\nhello\r\n", want: "hello"},
+		{raw: "$-1\r\n", want: nil},
+		{raw: "-ERR wrong type\r\n", err: redisError("ERR wrong type")},
+	}
+	for _, tt := range tests {
+		got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.raw)))
+		if got != tt.want || err != tt.err {
+			t.Errorf("readRedisReply(%q) = %v, %v; want %v, %v", tt.raw, got, err, tt.want, tt.err)
+		}
+	}
+
+	// An error inside an array is an item, so the rest is still read.
+	got, err := readRedisReply(bufio.NewReader(strings.NewReader("*3\r\n:1\r\n-ERR not an integer\r\n$-1\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := got.([]interface{})
+	if len(items) != 3 || items[0] != int64(1) || items[1] != redisError("ERR not an integer") || items[2] != nil {
+		t.Errorf("array reply = %#v", items)
+	}
+}
+
+func TestRedisTransaction(t *testing.T) {
+	server := newFakeRedis(t)
+	state, err := newStateStore(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := state.transaction([]string{"INCR", "n"}, []string{"INCR", "n"}, []string{"GET", "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[1] != int64(2) || replies[2] != "2" {
+		t.Errorf("transaction replies = %#v", replies)
+	}
+
+	server.mu.Lock()
+	server.data["text"] = "abc"
+	server.mu.Unlock()
+	if _, err := state.transaction([]string{"INCR", "text"}); !errors.As(err, new(redisError)) {
+		t.Errorf("transaction with a failing command = %v, want a redisError", err)
+	}
+}
+
+func TestRedisPipelineRetriesOnlyIdempotentCommands(t *testing.T) {
+	server := newFakeRedis(t)
+	client, err := newRedisClient(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read whose reply was lost is sent again on a new connection.
+	server.dropReplyAfter("GET")
+	if got, err := client.do("GET", "k"); err != nil || got != "v" {
+		t.Errorf("GET after a lost reply = %v, %v; want v", got, err)
+	}
+
+	// An INCR whose reply was lost may have run, so it is not sent again.
+	server.dropReplyAfter("INCR")
+	if _, err := client.do("INCR", "counter"); err == nil {
+		t.Error("INCR after a lost reply succeeded, want the network error")
+	}
+	if got := server.get("counter"); got != "1" {
+		t.Errorf("counter = %s after one INCR, want 1", got)
+	}
+
+	// A claim whose reply was lost would fail if sent again, as if another
+	// replica held it.
+	server.dropReplyAfter("SET")
+	if _, err := client.do("SET", "claim", "claimed", "NX", "PX", "1000"); err == nil || errors.As(err, new(redisError)) {
+		t.Errorf("SET NX after a lost reply = %v, want the network error", err)
+	}
+	if got := server.get("claim"); got != "claimed" {
+		t.Errorf("claim = %q, want it set by the first SET NX", got)
+	}
+
+	// The same goes for the streak transaction.
+	server.dropReplyAfter("EXEC")
+	if _, err := client.pipeline([]string{"MULTI"}, []string{"INCR", "counter"}, []string{"EXEC"}); err == nil {
+		t.Error("transaction after a lost reply succeeded, want the network error")
+	}
+	if got := server.get("counter"); got != "2" {
+		t.Errorf("counter = %s after two INCRs, want 2", got)
+	}
+
+	// The client reconnects for the next command.
+	if got, err := client.do("INCR", "counter"); err != nil || got != int64(3) {
+		t.Errorf("INCR after reconnecting = %v, %v; want 3", got, err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		cmds [][]string
+		want bool
+	}{
+		// Reads and overwrites.
+		{[][]string{{"GET", "k"}}, true},
+		{[][]string{{"get", "k"}}, true},
+		{[][]string{{"EXISTS", "k"}}, true},
+		{[][]string{{"PING"}}, true},
+		{[][]string{{"SET", "k", "processed", "PX", "1000"}}, true},
+		{[][]string{{"SET", "k", "v"}}, true},
+		{[][]string{{"DEL", "k"}}, true},
+		{[][]string{{"DEL", "a", "b"}}, true},
+		{[][]string{{"MULTI"}, {"SET", "k", "v"}, {"PEXPIRE", "k", "1000"}, {"EXEC"}}, true},
+		{[][]string{{"MULTI"}, {"GET", "a"}, {"GET", "b"}, {"EXEC"}}, true},
+		// Conditional sets, whose reply depends on whether they already ran.
+		{[][]string{{"SET", "k", "claimed", "NX", "PX", "1000"}}, false},
+		{[][]string{{"SET", "k", "claimed", "PX", "1000", "nx"}}, false},
+		{[][]string{{"SET", "k", "v", "XX"}}, false},
+		{[][]string{{"SET", "k", "v", "GET"}}, false},
+		// Counters and commands it doesn't know.
+		{[][]string{{"INCR", "k"}}, false},
+		{[][]string{{"MULTI"}, {"INCR", "k"}, {"PEXPIRE", "k", "1000"}, {"EXEC"}}, false},
+		{[][]string{{"AUTH", "secret"}}, false},
+		{[][]string{{"FLUSHALL"}}, false},
+		// A read and a delete, in a transaction or just pipelined.
+		{[][]string{{"MULTI"}, {"GET", "k"}, {"DEL", "k"}, {"EXEC"}}, false},
+		{[][]string{{"GET", "k"}, {"DEL", "k"}}, false},
+		{[][]string{{"DEL", "k"}, {"EXISTS", "k"}}, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.cmds); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.cmds, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// redisKeyPrefix namespaces the keys written to Redis.
+const redisKeyPrefix = "cloudbuildnotifier:"
+
+// streakTTL lets the failure streak of a trigger that stopped building
+// expire.
+const streakTTL = 30 * 24 * time.Hour
+
+// redisState keeps the state replicas share in Redis: the claimed and
+// processed builds, the failure streaks and the cooldown windows.
+type redisState struct {
+	client *redisClient
+}
+
+// newStateStore connects to a state store, e.g. "redis://host:6379/0" or
+// "rediss://:password@host:6380" for TLS. It returns nil when rawURL is
+// empty.
+func newStateStore(rawURL string) (*redisState, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisState{client: client}, nil
+}
+
+// useSharedState moves the dedup, failure streak and cooldown state to the
+// STATE_STORE, so replicas behind the same subscription send a build's
+// notification once and agree on streaks and cooldowns. DEDUP_STORE keeps
+// only the dedup state in a store, to survive restarts of a single replica.
+// Without either the state stays in memory.
+func (p *Processor) useSharedState() error {
+	state, err := newStateStore(os.Getenv("STATE_STORE"))
+	if err != nil {
+		return fmt.Errorf("STATE_STORE: %w", err)
+	}
+	if state != nil {
+		p.processed.store, p.failures.store, p.cooldowns.store = state, state, state
+	}
+	dedup, err := newStateStore(os.Getenv("DEDUP_STORE"))
+	if err != nil {
+		return fmt.Errorf("DEDUP_STORE: %w", err)
+	}
+	if dedup != nil {
+		p.processed.store = dedup
+	}
+	return nil
+}
+
+func (s *redisState) seen(key string) (bool, error) {
+	reply, err := s.client.do("GET", redisKeyPrefix+"dedup:"+key)
+	return reply == "processed", err
+}
+
+func (s *redisState) claim(key string, ttl time.Duration) (bool, error) {
+	reply, err := s.client.do("SET", redisKeyPrefix+"dedup:"+key, "claimed", "NX", "PX", millis(ttl))
+	return reply == "OK", err
+}
+
+func (s *redisState) release(key string) error {
+	_, err := s.client.do("DEL", redisKeyPrefix+"dedup:"+key)
+	return err
+}
+
+func (s *redisState) mark(key string, ttl time.Duration) error {
+	_, err := s.client.do("SET", redisKeyPrefix+"dedup:"+key, "processed", "PX", millis(ttl))
+	return err
+}
+
+func (s *redisState) record(key, buildID, status string) (failures, previous int, err error) {
+	k := redisKeyPrefix + "streak:" + key
+	switch status {
+	case "FAILURE", "SUCCESS":
+	default:
+		reply, err := s.client.do("GET", k)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := redisInt(reply)
+		return n, n, err
+	}
+	// The key's last build is kept with its counts, as "<build>/<status>
+	// <failures> <previous>", so recording it again returns them unchanged.
+	build := dedupKey(buildID, status)
+	reply, err := s.client.do("GET", k+":last")
+	if err != nil {
+		return 0, 0, err
+	}
+	if last, ok := reply.(string); ok {
+		var recorded string
+		var f, p int
+		if _, err := fmt.Sscanf(last, "%s %d %d", &recorded, &f, &p); err == nil && recorded == build {
+			return f, p, nil
+		}
+	}
+	if status == "FAILURE" {
+		replies, err := s.transaction([]string{"INCR", k}, []string{"PEXPIRE", k, millis(streakTTL)})
+		if err != nil {
+			return 0, 0, err
+		}
+		if failures, err = redisInt(replies[0]); err != nil {
+			return 0, 0, err
+		}
+		previous = failures - 1
+	} else {
+		replies, err := s.transaction([]string{"GET", k}, []string{"DEL", k})
+		if err != nil {
+			return 0, 0, err
+		}
+		if previous, err = redisInt(replies[0]); err != nil {
+			return 0, 0, err
+		}
+	}
+	last := fmt.Sprintf("%s %d %d", build, failures, previous)
+	if _, err := s.client.do("SET", k+":last", last, "PX", millis(streakTTL)); err != nil {
+		log.Printf("Could not record the last build of %s in the shared state: %v", key, err)
+	}
+	return failures, previous, nil
+}
+
+// heldCooldown is the last notification a shared cooldown held back.
+type heldCooldown struct {
+	Data     MessageData `json:"data"`
+	Channels []string    `json:"channels"`
+}
+
+func (s *redisState) start(key string, d time.Duration) (bool, error) {
+	reply, err := s.client.do("SET", redisKeyPrefix+"cooldown:"+key, "open", "NX", "PX", millis(d))
+	return reply == "OK", err
+}
+
+func (s *redisState) hold(key string, d time.Duration, data MessageData, channels []string) error {
+	last, err := json.Marshal(heldCooldown{Data: data, Channels: channels})
+	if err != nil {
+		return err
+	}
+	k := redisKeyPrefix + "cooldown:" + key
+	// The held keys outlive the window so the summary can still read them.
+	_, err = s.transaction(
+		[]string{"INCR", k + ":held"},
+		[]string{"PEXPIRE", k + ":held", millis(2 * d)},
+		[]string{"SET", k + ":last", string(last), "PX", millis(2 * d)},
+	)
+	return err
+}
+
+func (s *redisState) end(key string) (*cooldownWindow, error) {
+	k := redisKeyPrefix + "cooldown:" + key
+	replies, err := s.transaction([]string{"GET", k + ":held"}, []string{"GET", k + ":last"}, []string{"DEL", k + ":held", k + ":last"})
+	if err != nil {
+		return nil, err
+	}
+	w := &cooldownWindow{}
+	if w.suppressed, err = redisInt(replies[0]); err != nil || w.suppressed == 0 {
+		return w, err
+	}
+	last, _ := replies[1].(string)
+	var held heldCooldown
+	if err := json.Unmarshal([]byte(last), &held); err != nil {
+		return nil, fmt.Errorf("decode held notification: %v", err)
+	}
+	w.last, w.channels = held.Data, held.Channels
+	return w, nil
+}
+
+// transaction runs commands in a MULTI/EXEC block and returns their
+// replies.
+func (s *redisState) transaction(cmds ...[]string) ([]interface{}, error) {
+	cmds = append(append([][]string{{"MULTI"}}, cmds...), []string{"EXEC"})
+	replies, err := s.client.pipeline(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	results, ok := replies[len(replies)-1].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: transaction aborted")
+	}
+	for _, r := range results {
+		if err, ok := r.(redisError); ok {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// redisInt reads an integer reply, or a number stored as a string. A
+// missing key reads as zero.
+func redisInt(reply interface{}) (int, error) {
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
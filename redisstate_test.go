@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSharedDedupClaimIsNotSeen(t *testing.T) {
+	server := newFakeRedis(t)
+	clock := newFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	replicas := make([]*dedupCache, 2)
+	for i := range replicas {
+		store, err := newStateStore(server.url())
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[i] = newDedupCache(clock, time.Hour)
+		replicas[i].store = store
+	}
+	a, b := replicas[0], replicas[1]
+	key := dedupKey("build-1", "FAILURE")
+
+	if claimed, err := a.Claim(key, false); !claimed || err != nil {
+		t.Fatalf("first claim = %v, %v", claimed, err)
+	}
+	// A claim alone, e.g. of a replica that crashed, must not ack the
+	// redelivered message as a duplicate.
+	if b.Seen(key) {
+		t.Error("claimed build is seen as processed by the other replica")
+	}
+	if claimed, err := b.Claim(key, false); claimed || !errors.Is(err, errClaimedElsewhere) {
+		t.Errorf("claim held by the other replica = %v, %v; want errClaimedElsewhere", claimed, err)
+	}
+
+	a.Release(key, true)
+	if !b.Seen(key) {
+		t.Error("processed build is not seen by the other replica")
+	}
+	// A build the other replica processed is a duplicate, not redelivered.
+	if claimed, err := b.Claim(key, false); claimed || err != nil {
+		t.Errorf("claim of a build processed by the other replica = %v, %v; want a duplicate", claimed, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryClassifier is implemented by notifiers that post to an HTTP API and
+// know which of its failures are worth retrying. deliver retries their
+// ErrNotifierUnavailable errors up to NOTIFY_RETRIES times; notifiers that
+// retry on their own, like SNS through the AWS SDK, don't implement it.
+type retryClassifier interface {
+	isRetryable(statusCode int, body []byte) bool
+}
+
+// maxNotifyBackoff caps the wait between delivery attempts. A provider that
+// asks for a longer backoff gets no retry; the message is redelivered instead
+// where the receiver supports it.
+const maxNotifyBackoff = 30 * time.Second
+
+// maxErrorBody bounds how much of an error response is read to classify it.
+const maxErrorBody = 64 << 10
+
+// responseError turns a non-2xx response into a *StatusError, classifying it
+// as ErrNotifierUnavailable when retryable says so, with the backoff the
+// provider asked for.
+func responseError(service string, res *http.Response, retryable func(statusCode int, body []byte) bool) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	kind := ErrNotifierRejected
+	if retryable(res.StatusCode, body) {
+		kind = ErrNotifierUnavailable
+	}
+	return &StatusError{Service: service, StatusCode: res.StatusCode, Kind: kind, RetryAfter: retryAfterHint(res, body)}
+}
+
+// retryAfterHint reads a provider's backoff hint: the Retry-After header, in
+// seconds or as a date, or a JSON body "retry_after" in seconds as Discord
+// and Slack-compatible webhooks send it.
+func retryAfterHint(res *http.Response, body []byte) time.Duration {
+	if value := res.Header.Get("Retry-After"); value != "" {
+		if s, err := strconv.Atoi(value); err == nil {
+			return time.Duration(s) * time.Second
+		}
+		if t, err := http.ParseTime(value); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+	var hint struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if json.Unmarshal(body, &hint) == nil && hint.RetryAfter > 0 {
+		return time.Duration(hint.RetryAfter * float64(time.Second))
+	}
+	return 0
+}
+
+// statusRetryable is the usual classification: rate limiting and server
+// errors are transient, other failures are not.
+func statusRetryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// notifyEndpoints sends to the channel's notifier and, when that still
+// fails after its retries, to the channel's backup endpoints in order.
+func (p *Processor) notifyEndpoints(ctx context.Context, ch *channel, message string, data MessageData) error {
+	err := p.notifyWithRetry(ctx, ch, ch.notifier, message, data)
+	for _, backup := range ch.backups {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		logf(ctx, "Channel %s failed, falling over to %s: %v", ch.name, backup.name, err)
+		if err = p.notifyWithRetry(ctx, ch, backup.notifier, message, data); err == nil {
+			logf(ctx, "Channel %s delivered the message through %s", ch.name, backup.name)
+		}
+	}
+	return err
+}
+
+// notifyWithRetry calls a notifier of the channel, retrying transient
+// failures of retryClassifier notifiers with exponential backoff, or the
+// backoff the provider asked for. Each attempt gets the channel timeout.
+func (p *Processor) notifyWithRetry(ctx context.Context, ch *channel, notifier Notifier, message string, data MessageData) error {
+	_, retries := notifier.(retryClassifier)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, ch.timeout)
+		err := notifier.Notify(attemptCtx, message, data)
+		cancel()
+		if err == nil || !retries || attempt > p.notifyRetries || !errors.Is(err, ErrNotifierUnavailable) {
+			return err
+		}
+		wait := time.Second << (attempt - 1)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			wait = statusErr.RetryAfter
+		}
+		if wait > maxNotifyBackoff {
+			return err
+		}
+		logf(ctx, "Retrying channel %s in %s: %v", ch.name, wait, err)
+		select {
+		case <-p.clock.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// runningTracker holds the pending "still running" checks of WORKING builds
+// by build id.
+type runningTracker struct {
+	mu     sync.Mutex
+	clock  Clock
+	checks map[string]Timer
+}
+
+func newRunningTracker(clock Clock) *runningTracker {
+	return &runningTracker{clock: clock, checks: make(map[string]Timer)}
+}
+
+// watch calls f once the build has run for d, unless stop is called first.
+// Watching a build again, e.g. on a redelivered message, replaces its check.
+func (t *runningTracker) watch(info *CloudBuildInfo, d time.Duration, f func(running time.Duration)) {
+	started := info.StartTime
+	if started.IsZero() {
+		started = t.clock.Now()
+	}
+	wait := started.Add(d).Sub(t.clock.Now())
+	if wait < 0 {
+		wait = 0
+	}
+	id := info.ID
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.checks[id]; ok {
+		timer.Stop()
+	}
+	var timer Timer
+	timer = t.clock.AfterFunc(wait, func() {
+		t.mu.Lock()
+		current := t.checks[id] == timer
+		if current {
+			delete(t.checks, id)
+		}
+		t.mu.Unlock()
+		if current {
+			f(t.clock.Now().Sub(started))
+		}
+	})
+	t.checks[id] = timer
+}
+
+// stop cancels the check of a build that reached a terminal status.
+func (t *runningTracker) stop(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.checks[id]; ok {
+		timer.Stop()
+		delete(t.checks, id)
+	}
+}
+
+// notifyRunning tells the rule's channels that a build is still running.
+func (p *Processor) notifyRunning(ctx context.Context, rule *Rule, info *CloudBuildInfo, running time.Duration) {
+	text := runningTemplate
+	if rule.RunningAlertTemplate != "" {
+		text = rule.RunningAlertTemplate
+	}
+	data := MessageData{
+		Repo:          info.Substitutions.REPONAME,
+		Branch:        info.Substitutions.BRANCHNAME,
+		Tag:           info.Substitutions.TAGNAME,
+		Status:        info.Status,
+		BuildType:     rule.BuildType,
+		BuildId:       info.ID,
+		ShortBuildId:  shortID(info.ID),
+		ProjectId:     info.ProjectID,
+		Build:         info,
+		Extra:         p.config.Extra,
+		RunningTime:   running.Round(time.Minute),
+		CorrelationId: correlationID(ctx),
+		statusTexts:   p.config.StatusTexts,
+	}
+	if _, err := p.dispatchWith(ctx, rule.ChannelStrategy, rule.channelsFor(info), text, nil, data); err != nil {
+		log.Printf("Could not send the still running notification of build %s: %v", info.ID, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// payloadSchemaJSON is the JSON Schema of the fields of a Cloud Build
+// message the notifier relies on. Only the keywords type, required,
+// properties, items and enum are supported.
+//
+//go:embed payload_schema.json
+var payloadSchemaJSON []byte
+
+// jsonSchema is the supported subset of JSON Schema.
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []string               `json:"enum"`
+}
+
+var payloadSchema = func() *jsonSchema {
+	var s jsonSchema
+	if err := json.Unmarshal(payloadSchemaJSON, &s); err != nil {
+		panic(fmt.Sprintf("payload_schema.json: %v", err))
+	}
+	return &s
+}()
+
+// schemaProblem is a field of a payload that does not match the schema.
+type schemaProblem struct {
+	// Field is the path of the field with array indexes left out, e.g.
+	// "steps[].name", to label the metric with.
+	Field   string
+	Problem string
+}
+
+// checkPayload validates a build message against the bundled schema, so a
+// change of the message format shows up as warnings instead of blank
+// notifications. Fields the schema doesn't name are not checked.
+func checkPayload(data []byte) []schemaProblem {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []schemaProblem{{Field: "", Problem: err.Error()}}
+	}
+	return payloadSchema.check("", v, nil)
+}
+
+func (s *jsonSchema) check(field string, v interface{}, problems []schemaProblem) []schemaProblem {
+	if got := jsonType(v); s.Type != "" && got != s.Type {
+		return append(problems, schemaProblem{Field: field, Problem: fmt.Sprintf("expected %s, got %s", s.Type, got)})
+	}
+	switch v := v.(type) {
+	case string:
+		if len(s.Enum) > 0 && !contains(s.Enum, v) {
+			problems = append(problems, schemaProblem{Field: field, Problem: fmt.Sprintf("unexpected value %q", v)})
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, schemaProblem{Field: joinField(field, name), Problem: "missing"})
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := v[name]; ok {
+				problems = s.Properties[name].check(joinField(field, name), value, problems)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for _, item := range v {
+				problems = s.Items.check(field+"[]", item, problems)
+			}
+		}
+	}
+	return problems
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lifetimeStats counts what the processor did since it started.
+type lifetimeStats struct {
+	started    time.Time
+	processed  int64
+	notified   int64
+	failed     int64
+	suppressed int64
+}
+
+func (s *lifetimeStats) record(outcome string, err error) {
+	atomic.AddInt64(&s.processed, 1)
+	switch {
+	case err != nil:
+		atomic.AddInt64(&s.failed, 1)
+	case outcome == outcomeNotified:
+		atomic.AddInt64(&s.notified, 1)
+	default:
+		atomic.AddInt64(&s.suppressed, 1)
+	}
+}
+
+func (s *lifetimeStats) String() string {
+	return fmt.Sprintf("processed %d builds in %s: %d notified, %d without notification, %d failed",
+		atomic.LoadInt64(&s.processed), time.Since(s.started).Round(time.Second),
+		atomic.LoadInt64(&s.notified), atomic.LoadInt64(&s.suppressed), atomic.LoadInt64(&s.failed))
+}
+
+// shutdownSummary logs what the processor did in its lifetime and, with
+// SHUTDOWN_SUMMARY=true, also posts it to SHUTDOWN_CHANNEL ("hangout" by
+// default), which doubles as a notice that the notifier is restarting.
+func (p *Processor) shutdownSummary() {
+	summary := "cloudbuildnotifier " + version + " shutting down, " + p.stats.String()
+	log.Println(summary)
+	if os.Getenv("SHUTDOWN_SUMMARY") != "true" {
+		return
+	}
+	name := os.Getenv("SHUTDOWN_CHANNEL")
+	if name == "" {
+		name = legacyChannel
+	}
+	ch, ok := p.channels[name]
+	if !ok {
+		log.Printf("Could not send the shutdown summary: unknown channel %q", name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ch.timeout)
+	defer cancel()
+	if err := ch.notifier.Notify(ctx, summary, MessageData{}); err != nil {
+		log.Printf("Could not send the shutdown summary: %v", err)
+	}
+}
+
+// drainTimeout (DRAIN_TIMEOUT) bounds how long shutdown waits for the
+// messages being processed.
+func drainTimeout() time.Duration {
+	return getEnvDuration("DRAIN_TIMEOUT", 30*time.Second)
+}
+
+// waitTimeout waits for wg, giving up after d. It reports whether wg is done.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// flushPending sends what the processor still holds back for a window
+// before the process exits: the combined messages of aggregation windows,
+// pipeline digests so far and cooldown summaries. It waits up to
+// DRAIN_TIMEOUT for them. Notifications held back for quiet hours are
+// logged instead, since sending them now would break the quiet hours.
+func (p *Processor) flushPending() {
+	var sends []func()
+	for key, g := range p.aggregates.takeAll() {
+		if strings.HasPrefix(key, quietKeyPrefix) {
+			for _, b := range g.builds {
+				log.Printf("Undelivered notification held back for quiet hours: %s on %s, build %s, status %s",
+					b.Repo, b.Branch, b.ShortBuildId, b.Status)
+			}
+			continue
+		}
+		g := g
+		sends = append(sends, func() { g.send(g) })
+	}
+	sends = append(sends, p.cooldowns.endAll()...)
+	if len(sends) == 0 {
+		return
+	}
+	log.Printf("Sending %d held back notifications before shutting down", len(sends))
+	var wg sync.WaitGroup
+	for _, send := range sends {
+		wg.Add(1)
+		go func(send func()) {
+			defer wg.Done()
+			send()
+		}(send)
+	}
+	if !waitTimeout(&wg, drainTimeout()) {
+		log.Printf("Held back notifications still sending after DRAIN_TIMEOUT, they may be lost")
+	}
+}
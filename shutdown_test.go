@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFlushPendingSendsHeldBackNotifications(t *testing.T) {
+	config, err := parseConfig([]byte(`{
+		"hangout_urls": {"team": "https://chat.googleapis.com/v1/spaces/team/messages"},
+		"rules": [
+			{"repo_name": "api", "branches": ["main"], "channels": ["team"], "cooldown": "1h"},
+			{"repo_name": "web", "branches": ["main"], "channels": ["team"], "aggregate_window": "5m"}
+		]
+	}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, rec, _ := newTestProcessor(t, config)
+	ctx := context.Background()
+	for _, build := range [][]byte{
+		buildPayload("build-1", "FAILURE", "api", "main"),
+		buildPayload("build-2", "FAILURE", "api", "main"),
+		buildPayload("build-3", "SUCCESS", "web", "main"),
+	} {
+		if err := p.Process(ctx, build, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(rec.Messages()); got != 1 {
+		t.Fatalf("%d messages before shutdown, want 1", got)
+	}
+
+	p.flushPending()
+	messages := rec.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("%d messages after flushing, want the cooldown summary and the combined message too", len(messages))
+	}
+	for _, m := range messages[1:] {
+		switch {
+		case m.Data.Suppressed == 1:
+		case len(m.Data.Builds) == 1 && m.Data.Builds[0].ShortBuildId == "build-3":
+		default:
+			t.Errorf("unexpected message %q", m.Message)
+		}
+	}
+
+	// The windows were ended, so their timers send nothing more.
+	p.flushPending()
+	if got := len(rec.Messages()); got != 3 {
+		t.Errorf("%d messages after flushing twice, want 3", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotTest runs every *.json build message in dir through the config in
+// dry run and writes what each would send, in a stable order suitable for
+// comparing against a golden file in CI. Every file gets a fresh processor
+// whose clock is the build's finish (or create) time, and GitHub is not
+// called, so the output only depends on the config and the messages.
+func snapshotTest(config *Config, dir string, w io.Writer) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no *.json files in %s", dir)
+	}
+	sort.Strings(files)
+	failed := 0
+	for _, file := range files {
+		fmt.Fprintf(w, "== %s\n", filepath.Base(file))
+		if err := snapshotFile(config, file, w); err != nil {
+			fmt.Fprintf(w, "(error: %v)\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d snapshot files failed", failed, len(files))
+	}
+	return nil
+}
+
+func snapshotFile(config *Config, file string, w io.Writer) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var build CloudBuildInfo
+	if err := json.Unmarshal(data, &build); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	now := build.FinishTime
+	if now.IsZero() {
+		now = build.CreateTime
+	}
+	if now.IsZero() {
+		now = time.Unix(0, 0).UTC()
+	}
+	clock := newFakeClock(now)
+	processor := newProcessorWithClock(config, clock)
+	processor.dryRun = true
+	processor.offline = true
+	processor.recorder = NewRecordingNotifier(clock)
+	processor.history = NewBuildHistory(1)
+	if err := processor.Replay(context.Background(), data); err != nil {
+		return err
+	}
+	messages := processor.recorder.Messages()
+	if len(messages) == 0 {
+		outcome := "skipped"
+		if recent := processor.history.Recent(); len(recent) > 0 {
+			outcome = recent[0].Outcome
+		}
+		fmt.Fprintf(w, "(no notification: %s)\n", outcome)
+		return nil
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Channel < messages[j].Channel })
+	for _, m := range messages {
+		fmt.Fprintf(w, "[%s] %s\n", m.Channel, m.Message)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+//go:build sns
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// The SNS notifier pulls in the AWS SDK, so it is only built with -tags sns.
+func init() {
+	notifierTypes["sns"] = func(cc ChannelConfig) (Notifier, error) {
+		return NewSNSNotifier(context.Background(), cc.url())
+	}
+}
+
+// snsMaxLength is the largest message SNS accepts by default (256 KiB). SNS
+// counts UTF-8 bytes, not characters, so Notify truncates by bytes too.
+const snsMaxLength = 256 * 1024
+
+// SNSNotifier publishes messages to an Amazon SNS topic, with the build
+// status and repo as message attributes so subscriptions can filter on them.
+type SNSNotifier struct {
+	TopicARN string
+	client   *sns.Client
+}
+
+// NewSNSNotifier returns a notifier for topicARN, or SNS_TOPIC_ARN when it
+// is empty, using the standard AWS credential chain.
+func NewSNSNotifier(ctx context.Context, topicARN string) (*SNSNotifier, error) {
+	if topicARN == "" {
+		topicARN = os.Getenv("SNS_TOPIC_ARN")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SNSNotifier{TopicARN: topicARN, client: sns.NewFromConfig(cfg)}, nil
+}
+
+func (n *SNSNotifier) MaxLength() int {
+	return snsMaxLength
+}
+
+func (n *SNSNotifier) Notify(ctx context.Context, message string, data MessageData) error {
+	if n.TopicARN == "" {
+		return fmt.Errorf("%w: SNS_TOPIC_ARN is not set", ErrConfig)
+	}
+	attributes := map[string]types.MessageAttributeValue{}
+	for name, value := range map[string]string{"status": data.Status, "repo": data.Repo, "branch": data.Branch} {
+		// SNS rejects empty attribute values.
+		if value != "" {
+			attributes[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	_, err := n.client.Publish(ctx, &sns.PublishInput{
+		TopicArn:          aws.String(n.TopicARN),
+		Message:           aws.String(truncateMessageBytes(message, snsMaxLength)),
+		Subject:           aws.String(truncateMessage(fmt.Sprintf("%s build %s on %s", data.Repo, data.Status, data.Branch), 100)),
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: sns publish: %v", ErrNotifierUnavailable, err)
+	}
+	return nil
+}
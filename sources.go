@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// The default sources read the substitutions Cloud Build sets for builds
+// started by a trigger on a connected repository.
+var (
+	defaultRepoSources   = []string{"substitution:REPO_NAME"}
+	defaultBranchSources = []string{"substitution:BRANCH_NAME"}
+	defaultCommitSources = []string{"substitution:COMMIT_SHA"}
+)
+
+// Source fields of a build that can be named in the config source lists.
+var sourceFields = map[string]func(info *CloudBuildInfo) string{
+	"source.repoSource.repoName":   func(info *CloudBuildInfo) string { return info.Source.RepoSource.RepoName },
+	"source.repoSource.branchName": func(info *CloudBuildInfo) string { return info.Source.RepoSource.BranchName },
+	"source.repoSource.commitSha":  func(info *CloudBuildInfo) string { return info.Source.RepoSource.CommitSha },
+	"sourceProvenance.resolvedRepoSource.commitSha": func(info *CloudBuildInfo) string {
+		return info.SourceProvenance.ResolvedRepoSource.CommitSha
+	},
+}
+
+// checkSource reports whether source is one lookupSource understands:
+// "substitution:NAME", "tag:PREFIX" or one of the sourceFields.
+func checkSource(source string) error {
+	if strings.HasPrefix(source, "substitution:") || strings.HasPrefix(source, "tag:") {
+		return nil
+	}
+	if _, ok := sourceFields[source]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown source %q", source)
+}
+
+// lookupSource reads source from a build. A "tag:PREFIX" source takes the
+// rest of the first tag starting with PREFIX, e.g. "tag:repo-" reads "api"
+// from the tag "repo-api".
+func lookupSource(info *CloudBuildInfo, source string) string {
+	switch {
+	case strings.HasPrefix(source, "substitution:"):
+		return info.Substitutions.Get(strings.TrimPrefix(source, "substitution:"))
+	case strings.HasPrefix(source, "tag:"):
+		prefix := strings.TrimPrefix(source, "tag:")
+		for _, tag := range info.Tags {
+			if strings.HasPrefix(tag, prefix) {
+				return strings.TrimPrefix(tag, prefix)
+			}
+		}
+		return ""
+	}
+	if field, ok := sourceFields[source]; ok {
+		return field(info)
+	}
+	return ""
+}
+
+// firstSource returns the value of the first source set on the build.
+func firstSource(info *CloudBuildInfo, what string, sources []string) string {
+	for _, source := range sources {
+		if value := lookupSource(info, source); value != "" {
+			slog.Debug("Resolved build "+what, "build", info.ID, "source", source, "value", value)
+			return value
+		}
+	}
+	return ""
+}
+
+// resolveIdentity fills in the repo name, branch and commit SHA
+// substitutions from the configured sources, so the rest of the notifier
+// can rely on them whatever the build configuration.
+func (c *Config) resolveIdentity(info *CloudBuildInfo) {
+	info.Substitutions.REPONAME = firstSource(info, "repo", orDefault(c.RepoSources, defaultRepoSources))
+	info.Substitutions.BRANCHNAME = firstSource(info, "branch", orDefault(c.BranchSources, defaultBranchSources))
+	info.Substitutions.COMMITSHA = firstSource(info, "commit", orDefault(c.CommitSources, defaultCommitSources))
+}
+
+func orDefault(values, def []string) []string {
+	if len(values) == 0 {
+		return def
+	}
+	return values
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// FailureTracker counts consecutive failed builds per trigger and branch.
+type FailureTracker struct {
+	mu     sync.Mutex
+	counts map[string]int
+	// last is the build last recorded per key, so a redelivered message of
+	// it doesn't extend the streak again.
+	last map[string]recordedBuild
+	// store, when set, keeps the streaks for every replica.
+	store streakStore
+}
+
+// recordedBuild is a build status a FailureTracker recorded, with what
+// Record returned for it.
+type recordedBuild struct {
+	build              string
+	failures, previous int
+}
+
+// streakStore shares failure streaks between replicas; record is
+// FailureTracker.Record.
+type streakStore interface {
+	record(key, buildID, status string) (failures, previous int, err error)
+}
+
+func NewFailureTracker() *FailureTracker {
+	return &FailureTracker{counts: make(map[string]int), last: make(map[string]recordedBuild)}
+}
+
+// Record updates the streak for key with a build status. It returns the
+// number of consecutive failures including this build, and the length of the
+// streak before it. A SUCCESS resets the streak; statuses other than SUCCESS
+// and FAILURE leave it untouched. Recording the key's last build and status
+// again returns the same counts without changing the streak.
+func (t *FailureTracker) Record(key, buildID, status string) (failures, previous int) {
+	if t.store != nil {
+		failures, previous, err := t.store.record(key, buildID, status)
+		if err == nil {
+			return failures, previous
+		}
+		log.Printf("Could not record %s in the shared state, using the local streak: %v", key, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	build := dedupKey(buildID, status)
+	if last, ok := t.last[key]; ok && last.build == build {
+		return last.failures, last.previous
+	}
+	previous = t.counts[key]
+	switch status {
+	case "SUCCESS":
+		delete(t.counts, key)
+	case "FAILURE":
+		t.counts[key]++
+	}
+	t.last[key] = recordedBuild{build: build, failures: t.counts[key], previous: previous}
+	return t.counts[key], previous
+}
+
+// failureKey identifies the stream of builds a failure streak belongs to.
+// Manually started builds have no trigger, so the repo name stands in for it.
+func failureKey(info *CloudBuildInfo) string {
+	trigger := info.BuildTriggerID
+	if trigger == "" {
+		trigger = info.Substitutions.REPONAME
+	}
+	return trigger + "/" + info.Substitutions.BRANCHNAME
+}
+
+// buildTracker remembers the create time of the newest build seen per
+// trigger and branch, to tell when a cancelled build was superseded.
+type buildTracker struct {
+	mu     sync.Mutex
+	newest map[string]time.Time
+}
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{newest: make(map[string]time.Time)}
+}
+
+// see records a build.
+func (t *buildTracker) see(info *CloudBuildInfo) {
+	if info.CreateTime.IsZero() {
+		return
+	}
+	key := failureKey(info)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info.CreateTime.After(t.newest[key]) {
+		t.newest[key] = info.CreateTime
+	}
+}
+
+// superseded reports whether a newer build of the same trigger and branch
+// has been seen.
+func (t *buildTracker) superseded(info *CloudBuildInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !info.CreateTime.IsZero() && t.newest[failureKey(info)].After(info.CreateTime)
+}
+
+// attemptCounter counts attempts per key, e.g. redeliveries of a build.
+type attemptCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{counts: make(map[string]int)}
+}
+
+// next records an attempt for key and returns the number of attempts so far.
+func (c *attemptCounter) next(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+	return c.counts[key]
+}
+
+func (c *attemptCounter) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counts, key)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestFailureStreakCountsRedeliveriesOnce(t *testing.T) {
+	shared := NewFailureTracker()
+	store, err := newStateStore(newFakeRedis(t).url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared.store = store
+	trackers := map[string]*FailureTracker{"local": NewFailureTracker(), "shared": shared}
+
+	steps := []struct {
+		build, status      string
+		failures, previous int
+	}{
+		{"b1", "FAILURE", 1, 0},
+		{"b1", "FAILURE", 1, 0}, // redelivered after a failed dispatch
+		{"b2", "FAILURE", 2, 1},
+		{"b2", "FAILURE", 2, 1},
+		{"b3", "WORKING", 2, 2},
+		{"b3", "SUCCESS", 0, 2},
+		{"b3", "SUCCESS", 0, 2}, // the recovery still sees the streak
+		{"b4", "FAILURE", 1, 0},
+	}
+	for name, tracker := range trackers {
+		for i, step := range steps {
+			failures, previous := tracker.Record("trigger/main", step.build, step.status)
+			if failures != step.failures || previous != step.previous {
+				t.Errorf("%s: step %d: Record(%s, %s) = %d, %d; want %d, %d",
+					name, i, step.build, step.status, failures, previous, step.failures, step.previous)
+			}
+		}
+	}
+}
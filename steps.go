@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Duration returns how long the step ran, or false when the payload has no
+// timing for it (e.g. the step was skipped or is still running).
+func (s Steps) Duration() (time.Duration, bool) {
+	if s.Timing.StartTime.IsZero() || s.Timing.EndTime.IsZero() {
+		return 0, false
+	}
+	return s.Timing.EndTime.Sub(s.Timing.StartTime), true
+}
+
+// label names the step by its id, or its builder image when it has none.
+func (s Steps) label() string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return s.Name
+}
+
+// failedStep names the last failed step: by id, builder image or, when it
+// has neither, position ("step 3", counting from 1). It returns "" when no
+// step failed.
+func failedStep(steps []Steps) string {
+	name := ""
+	for i, step := range steps {
+		if step.Status != "FAILURE" {
+			continue
+		}
+		name = step.label()
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+	}
+	return name
+}
+
+type stepDuration struct {
+	label    string
+	duration time.Duration
+}
+
+// slowestStepsTable formats the n slowest timed steps as an aligned table,
+// or returns "" when no step has timing data.
+func slowestStepsTable(steps []Steps, n int) string {
+	var timed []stepDuration
+	for _, step := range steps {
+		if d, ok := step.Duration(); ok {
+			timed = append(timed, stepDuration{label: step.label(), duration: d})
+		}
+	}
+	if len(timed) == 0 {
+		return ""
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].duration > timed[j].duration })
+	if len(timed) > n {
+		timed = timed[:n]
+	}
+	width := 0
+	for _, t := range timed {
+		if len(t.label) > width {
+			width = len(t.label)
+		}
+	}
+	var b strings.Builder
+	for _, t := range timed {
+		fmt.Fprintf(&b, "%-*s  %s\n", width, t.label, t.duration.Round(time.Second))
+	}
+	return b.String()
+}
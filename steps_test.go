@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestFailedStep(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Steps
+		want  string
+	}{
+		{"no failure", []Steps{{ID: "build", Status: "SUCCESS"}}, ""},
+		{"by id", []Steps{{ID: "build", Status: "SUCCESS"}, {ID: "test", Name: "golang", Status: "FAILURE"}}, "test"},
+		{"no id", []Steps{{ID: "build", Status: "SUCCESS"}, {Name: "gcr.io/cloud-builders/docker", Status: "FAILURE"}}, "gcr.io/cloud-builders/docker"},
+		{"no id or image", []Steps{{ID: "build", Status: "SUCCESS"}, {Status: "SUCCESS"}, {Status: "FAILURE"}}, "step 3"},
+		{"last failure", []Steps{{ID: "lint", Status: "FAILURE"}, {Status: "FAILURE"}}, "step 2"},
+	}
+	for _, tt := range tests {
+		if got := failedStep(tt.steps); got != tt.want {
+			t.Errorf("%s: failedStep = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MessageData is what rule templates are rendered against.
+type MessageData struct {
+	Repo   string
+	Branch string
+	// Tag is the tag of builds started by a tag push, which have no Branch.
+	Tag         string
+	Status      string
+	FailureStep string
+	BuildType   string
+	// BuildId is the Cloud Build id, ShortBuildId its first 8 characters and
+	// ProjectId the project the build ran in.
+	BuildId      string
+	ShortBuildId string
+	ProjectId    string
+	Commit       GithubInfo
+	// ShortSha is the commit SHA cut to SHORT_SHA_LENGTH (7 by default);
+	// {{.CommitLink}} links it to the commit.
+	ShortSha string
+	// PullRequest is the PR the commit belongs to, looked up only when
+	// GITHUB_LOOKUP_PRS is set; nil otherwise or when there is none.
+	PullRequest *PullRequest
+	// ConsecutiveFailures counts the failed builds in a row for the trigger
+	// and branch, including this one. It is 0 for successful builds.
+	ConsecutiveFailures int
+	// RecoveredAfter is the length of the failure streak a SUCCESS ended.
+	RecoveredAfter int
+	Mention        string
+	// SlowestSteps is a table of the slowest steps, set for successful
+	// builds when the rule enables ShowSlowestSteps.
+	SlowestSteps string
+	Build        *CloudBuildInfo
+	// VerifyError says why the post-deploy check of a Verify rule failed.
+	VerifyError string
+	// Suppressed is the number of notifications a rule Cooldown held back,
+	// set for the summary sent when it ends.
+	Suppressed int
+	// Extra holds the deployment-wide EXTRA_CONTEXT values.
+	Extra map[string]string
+	// Substitutions lists the custom "_" substitutions of a failed build for
+	// ShowSubstitutions rules, one "_NAME=value" per line.
+	Substitutions string
+	// Builds are the builds of the commit combined by a rule's
+	// AggregateWindow, of a Digest or held back during quiet hours; for an
+	// AggregateWindow Status is the first failed status among them.
+	Builds []AggregatedBuild
+	// Attributes are the Pub/Sub attributes of the build message, e.g.
+	// {{.Attributes.buildId}}. Polled builds only have the buildId and status
+	// the poller fills in; replayed builds have none.
+	Attributes map[string]string
+	// FilesChanged and LinesChanged come from the commit stats, which only
+	// the /commits GitHub endpoint returns; they are 0 without them. That
+	// endpoint lists at most 300 files, so FilesChanged stops there and
+	// FilesChangedCapped is set; {{.FilesChangedText}} shows it as "300+".
+	FilesChanged       int
+	FilesChangedCapped bool
+	LinesChanged       int
+	// LargeChange is set when the commit exceeds the rule's LargeChange
+	// thresholds.
+	LargeChange bool
+	// ExternalAuthor is set when the commit author is outside the
+	// organization; see the config InternalDomains.
+	ExternalAuthor bool
+	// Identity is the config CommitIdentity: which of the commit author and
+	// committer are shown.
+	Identity string
+	// FailureCategory names the config FailureCategories entry a failed
+	// build falls in, and Runbook is its runbook URL.
+	FailureCategory string
+	Runbook         string
+	// FailureType and FailureDetail are the build's failureInfo, when Cloud
+	// Build gives one.
+	FailureType   string
+	FailureDetail string
+	// FirstDeployToday is set for the first SUCCESS of the day of a
+	// FirstDeployOfDay rule.
+	FirstDeployToday bool
+	// QueueTime is how long the build waited to start, set for QueueSLA
+	// alerts.
+	QueueTime time.Duration
+	// RunningTime is how long the build has been running, set for
+	// RunningAlert notifications.
+	RunningTime time.Duration
+	// Digest names the pipeline run of a Digest summary, and Missing counts
+	// the expected builds that did not report.
+	Digest  string
+	Missing int
+	// NoOp is set for builds that had nothing to do; see Rule.NoOp.
+	NoOp bool
+	// CorrelationId tags the log entries about the build: its id, or a
+	// random UUID for payloads without one.
+	CorrelationId string
+	// Locale is the locale of the channel the message is rendered for.
+	Locale string
+	// Markdown is set when the channel renders markdown.
+	Markdown bool
+	// statusTexts are the config StatusTexts; see StatusText.
+	statusTexts map[string]map[string]string
+	// thread names the thread the message is posted in, for messages sent
+	// as a summary with threaded continuations; see deliverThread.
+	thread string
+	// Card is set when the notifier shows the commit message in a card, so
+	// templates can leave it out of the text.
+	Card bool
+}
+
+// commitDetails leaves the commit out when there is none, e.g. for builds
+// without a commit SHA or when the GitHub lookup failed. The commit subject
+// is shown in bold above the details, which hold the shortened body.
+const commitDetails = "{{if and .Commit.SHA (not .Card)}}*{{.CommitSubject}}*\n{{end}}Detail infomations: ```Repo: {{.Repo}}\nBranch: {{.Branch}}\n{{if and .Commit.SHA (not .Card)}}{{with .CommitBody}}Commit message: {{.}}\n{{end}}{{end}}{{with .Commit.HTML_URL}}Commit Url: {{.}}\n{{end}}{{with .PullRequest}}Pull request: #{{.Number}} {{.Title}} ({{.HTMLURL}})\n{{end}}{{if .Commit.SHA}}{{if ne .Identity \"committer\"}}Author: {{.Commit.Author.Name}}({{.Commit.Author.Email}})\n{{end}}{{if ne .Identity \"author\"}}Committer:{{.Commit.Committer.Name}}({{.Commit.Committer.Email}})\n{{end}}{{end}}```"
+
+// substitutionsBlock is added to failure notifications of
+// ShowSubstitutions rules.
+const substitutionsBlock = "\nSubstitutions: ```{{.Substitutions}}```"
+
+// runbookLine is added to failure notifications whose category has a
+// runbook.
+const runbookLine = "\nSee runbook: {{.Runbook}}"
+
+// threadSummarySuffix ends the summary of a message continued in a thread.
+const threadSummarySuffix = " (full details in the thread)"
+
+// correlationLine is added to notifications when CORRELATION_FOOTER is set,
+// to find the log entries about a build from its notification.
+const correlationLine = "\nRef: {{.CorrelationId}}"
+
+const buildID = "Build *{{.ShortBuildId}}*{{with .ProjectId}} in *{{.}}*{{end}}. "
+
+// failureInfo shows the reason Cloud Build gives for a failure.
+const failureInfo = "{{with .FailureType}}Failure type: *{{.}}*. {{end}}{{with .FailureDetail}}{{.}} {{end}}"
+
+const slowestSteps = "{{with .SlowestSteps}}\nSlowest steps: ```{{.}}```{{end}}"
+
+// defaultTemplate is used by rules without a template, unless the config
+// sets its own DefaultTemplate. Like every template it is rendered with
+// MessageData: besides the build's .Repo, .Branch (or .Tag), .Status and
+// .FailureStep, it shows the .Commit with its author and the build log.
+// QUEUED and WORKING builds, which have not finished, are shown as started.
+const defaultTemplate = "{{with .Mention}}{{.}} {{end}}{{if eq .Status \"QUEUED\" \"WORKING\"}}⏳ *{{.Repo}}* on *{{or .Branch .Tag}}* {{.StatusText}}. " + buildID + "{{else}}{{if eq .Status \"SUCCESS\"}}✅{{else}}❌{{end}} *{{.Repo}}* on *{{or .Branch .Tag}}* *{{.StatusText}}*{{with .FailureStep}} at step *{{.}}*{{end}}. " + buildID + failureInfo + "{{end}}{{with .Build}}{{.LogURL}}{{end}}\n" + commitDetails
+
+const (
+	supersetSuccessTemplate      = "The new version of *actable-dev* was available in https://dev-nightly.actable.ai. " + commitDetails + slowestSteps
+	supersetFailureTemplate      = "{{with .Mention}}{{.}} {{end}}The deployment of *actable-dev* on https://dev-nightly.actable.ai *{{.StatusText}}* at step *{{.FailureStep}}*{{if gt .ConsecutiveFailures 1}} ({{.ConsecutiveFailures}} failures in a row){{end}}. " + buildID + failureInfo + commitDetails
+	recoveredTemplate            = "✅ Recovered after {{.RecoveredAfter}} failure{{if gt .RecoveredAfter 1}}s{{end}}: *{{.Repo}}* on *{{.Branch}}* is green again. " + commitDetails
+	verifyFailedTemplate         = "⚠️ *{{.Repo}}* on *{{.Branch}}* was built, but the deploy may have failed to come up: {{.VerifyError}}. " + commitDetails
+	internalErrorTemplate        = "{{with .Mention}}{{.}} {{end}}🛠️ Cloud Build hit an internal error while building *{{.Repo}}* on *{{.Branch}}*{{with .FailureStep}} at step *{{.}}*{{end}}. This is most likely a Cloud Build or infrastructure problem, not a fault of the commit; retrying the build usually helps. " + buildID + failureInfo + commitDetails
+	runningTemplate              = "⏱️ Build *{{.ShortBuildId}}* of *{{.Repo}}* on *{{.Branch}}* is still running after {{.RunningTime}}. {{with .Build}}{{.LogURL}}{{end}}"
+	queueSLATemplate             = "⏳ Build *{{.ShortBuildId}}* of *{{.Repo}}* on *{{.Branch}}* was queued for {{.QueueTime}} before starting, possible capacity issue. {{with .Build}}{{.LogURL}}{{end}}"
+	noOpTemplate                 = "ℹ️ *{{.Repo}}* on *{{.Branch}}* built with nothing to deploy. " + buildID + "{{with .Build}}{{.LogURL}}{{end}}"
+	quietBatchTemplate           = "🌙 {{len .Builds}} notification{{if gt (len .Builds) 1}}s{{end}} held back during quiet hours:\n{{range .Builds}}{{if eq .Status \"SUCCESS\"}}✅{{else}}ℹ️{{end}} *{{.Repo}}* on *{{.Branch}}*: {{.Name}} {{$.StatusTextFor .Status}} {{.LogURL}}\n{{end}}"
+	digestTemplate               = "{{with .Mention}}{{.}} {{end}}{{if .FailedBuilds}}❌{{else}}✅{{end}} *{{.Digest}}* complete: {{len .SucceededBuilds}} succeeded, {{len .FailedBuilds}} failed{{with .FailedBuilds}} ({{range $i, $b := .}}{{if $i}}, {{end}}{{$b.Name}}{{end}}){{end}}{{with .Missing}}, {{.}} did not report{{end}}."
+	supersededTemplate           = "ℹ️ Build *{{.ShortBuildId}}* of *{{.Repo}}* on *{{.Branch}}* was cancelled in favour of a newer build."
+	aggregateTemplate            = "{{with .Mention}}{{.}} {{end}}{{if eq .Status \"SUCCESS\"}}✅{{else}}❌{{end}} {{len .Builds}} build{{if gt (len .Builds) 1}}s{{end}} of *{{.Repo}}* on *{{.Branch}}*:\n{{range .Builds}}{{if .Failed}}❌ *{{.Name}} {{$.StatusTextFor .Status}}{{with .FailureStep}} at step {{.}}{{end}}*{{else}}✅ {{.Name}} {{$.StatusTextFor .Status}}{{end}} {{.LogURL}}\n{{end}}" + commitDetails
+	cooldownSummaryTemplate      = "🔇 {{.Suppressed}} more notification{{if gt .Suppressed 1}}s{{end}} for *{{.Repo}}* on *{{.Branch}}* {{if gt .Suppressed 1}}were{{else}}was{{end}} held back during the cooldown. The latest build *{{.StatusText}}*."
+	releaseTemplate              = "{{if eq .Status \"SUCCESS\"}}🚀 Release *{{.Tag}}* of *{{.Repo}}* deployed. {{else}}{{with .Mention}}{{.}} {{end}}Release *{{.Tag}}* of *{{.Repo}}* *{{.StatusText}}* at step *{{.FailureStep}}*. " + buildID + failureInfo + "{{end}}" + commitDetails
+	summaryTemplate              = "{{if eq .Status \"SUCCESS\"}}✅{{else}}❌{{end}} {{.Repo}}@{{or .Branch .Tag}} {{.StatusText}}{{with .FailureStep}} at step {{.}}{{end}}{{with .Build}}{{with .Substitutions.SHORTSHA}} ({{.}}{{with $.PrimaryName}} by {{.}}{{end}}){{end}}{{end}}"
+	unconfiguredRepoTemplate     = "ℹ️ A build of unconfigured repo *{{.Repo}}* on *{{.Branch}}* *{{.StatusText}}*. {{with .Build}}{{.LogURL}}{{end}}"
+	projectStrandFailureTemplate = "{{with .Mention}}{{.}} {{end}}Cloud build for *{{.BuildType}}* *{{.StatusText}}* at step *{{.FailureStep}}*{{if gt .ConsecutiveFailures 1}} ({{.ConsecutiveFailures}} failures in a row){{end}}. " + buildID + failureInfo + commitDetails
+)
+
+// defaultLocale is used by channels without a Locale.
+const defaultLocale = "en"
+
+// timeLayouts are the date formats of the supported locales.
+var timeLayouts = map[string]string{
+	"en": "Jan 2, 2006 15:04 MST",
+	"vi": "15:04 02/01/2006 MST",
+}
+
+// FormatTime formats t for the channel's locale, falling back to English.
+// Templates call it as {{.FormatTime .Build.FinishTime}}.
+func (d MessageData) FormatTime(t time.Time) string {
+	layout, ok := timeLayouts[d.Locale]
+	if !ok {
+		layout = timeLayouts[defaultLocale]
+	}
+	return t.Format(layout)
+}
+
+// PrimaryName is the name of the commit author, or of the committer when
+// the config CommitIdentity is "committer".
+func (d MessageData) PrimaryName() string {
+	if d.Identity == identityCommitter {
+		return d.Commit.Committer.Name
+	}
+	return d.Commit.Author.Name
+}
+
+// PrimaryEmail is the email of the person PrimaryName names.
+func (d MessageData) PrimaryEmail() string {
+	if d.Identity == identityCommitter {
+		return d.Commit.Committer.Email
+	}
+	return d.Commit.Author.Email
+}
+
+// statusTexts are the built-in phrases for build statuses by locale.
+var statusTexts = map[string]map[string]string{
+	"en": {
+		"SUCCESS":        "succeeded",
+		"FAILURE":        "failed",
+		"TIMEOUT":        "timed out",
+		"INTERNAL_ERROR": "hit an internal error",
+		"CANCELLED":      "was cancelled",
+		"EXPIRED":        "expired",
+		"QUEUED":         "is queued",
+		"WORKING":        "is running",
+	},
+	"vi": {
+		"SUCCESS":        "thành công",
+		"FAILURE":        "thất bại",
+		"TIMEOUT":        "quá thời gian",
+		"INTERNAL_ERROR": "gặp lỗi nội bộ",
+		"CANCELLED":      "đã bị huỷ",
+		"EXPIRED":        "đã hết hạn",
+		"QUEUED":         "đang chờ",
+		"WORKING":        "đang chạy",
+	},
+}
+
+// StatusText is the status as a phrase for the channel's locale, e.g.
+// "failed" for FAILURE, from the config StatusTexts or the built-in ones,
+// falling back to English and then to the status itself. The built-in
+// templates show it rather than the raw status.
+func (d MessageData) StatusText() string {
+	return d.StatusTextFor(d.Status)
+}
+
+// StatusTextFor is StatusText for another status, e.g. of one of the
+// .Builds: {{range .Builds}}{{$.StatusTextFor .Status}}{{end}}.
+func (d MessageData) StatusTextFor(status string) string {
+	for _, locale := range []string{d.Locale, defaultLocale} {
+		if text, ok := d.statusTexts[locale][status]; ok {
+			return text
+		}
+		if text, ok := statusTexts[locale][status]; ok {
+			return text
+		}
+	}
+	return status
+}
+
+// FilesChangedText is FilesChanged, with a "+" when GitHub capped it.
+func (d MessageData) FilesChangedText() string {
+	if d.FilesChangedCapped {
+		return strconv.Itoa(d.FilesChanged) + "+"
+	}
+	return strconv.Itoa(d.FilesChanged)
+}
+
+// CommitLink is the short SHA linked to the commit where the channel
+// renders links, or followed by the commit URL where it doesn't.
+func (d MessageData) CommitLink() string {
+	switch {
+	case d.Commit.HTML_URL == "":
+		return d.ShortSha
+	case d.Markdown:
+		return "<" + d.Commit.HTML_URL + "|" + d.ShortSha + ">"
+	}
+	return d.ShortSha + " (" + d.Commit.HTML_URL + ")"
+}
+
+// CommitSubject is the subject of the commit message: its first paragraph,
+// on one line.
+func (d MessageData) CommitSubject() string {
+	subject, _ := splitCommitMessage(d.Commit.Message)
+	return subject
+}
+
+// CommitBody is the commit message after the subject, cut to
+// COMMIT_BODY_MAX_LENGTH characters (300 by default, 0 for no limit). It is
+// empty for single-line messages.
+func (d MessageData) CommitBody() string {
+	_, body := splitCommitMessage(d.Commit.Message)
+	return truncateMessage(body, getEnvInt("COMMIT_BODY_MAX_LENGTH", 300))
+}
+
+// splitCommitMessage splits a commit message at its first blank line.
+func splitCommitMessage(message string) (subject, body string) {
+	message = strings.TrimSpace(strings.Replace(message, "\r\n", "\n", -1))
+	subject = message
+	if i := strings.Index(message, "\n\n"); i >= 0 {
+		subject, body = message[:i], strings.TrimSpace(message[i+2:])
+	}
+	return strings.Join(strings.Fields(subject), " "), body
+}
+
+// SucceededBuilds are the successful ones of the combined Builds.
+func (d MessageData) SucceededBuilds() []AggregatedBuild {
+	var builds []AggregatedBuild
+	for _, b := range d.Builds {
+		if !b.Failed() {
+			builds = append(builds, b)
+		}
+	}
+	return builds
+}
+
+// FailedBuilds are the combined Builds that did not succeed.
+func (d MessageData) FailedBuilds() []AggregatedBuild {
+	var builds []AggregatedBuild
+	for _, b := range d.Builds {
+		if b.Failed() {
+			builds = append(builds, b)
+		}
+	}
+	return builds
+}
+
+// shortSHA cuts a commit SHA to SHORT_SHA_LENGTH characters.
+func shortSHA(sha string) string {
+	if n := getEnvInt("SHORT_SHA_LENGTH", 7); n > 0 && len(sha) > n {
+		return sha[:n]
+	}
+	return sha
+}
+
+// Finished is the build finish time formatted for the channel's locale.
+func (d MessageData) Finished() string {
+	if d.Build == nil || d.Build.FinishTime.IsZero() {
+		return ""
+	}
+	return d.FormatTime(d.Build.FinishTime)
+}
+
+// decorate adds a prefix and suffix to a template and its localized
+// versions.
+func decorate(text string, localized map[string]string, prefix, suffix string) (string, map[string]string) {
+	var decorated map[string]string
+	if len(localized) > 0 {
+		decorated = make(map[string]string, len(localized))
+		for locale, t := range localized {
+			decorated[locale] = prefix + t + suffix
+		}
+	}
+	return prefix + text + suffix, decorated
+}
+
+// templateFuncs are the functions every message template can call:
+//
+//	upper s              s in upper case, e.g. {{upper .Status}}
+//	lower s              s in lower case
+//	truncate n s         s cut to n characters, ending with "…",
+//	                     e.g. {{.Commit.Message | truncate 80}}
+//	formatTime layout tz t
+//	                     t in the Go layout and IANA time zone (UTC when
+//	                     empty), e.g. {{formatTime "15:04" "Asia/Ho_Chi_Minh"
+//	                     .Build.FinishTime}}; empty for a zero time
+//	shortSha s           s cut to SHORT_SHA_LENGTH characters
+//	default fallback v   v, or fallback when v is empty, e.g.
+//	                     {{.Tag | default "untagged"}}
+var templateFuncs = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"truncate":   truncateText,
+	"formatTime": formatTimeIn,
+	"shortSha":   shortSHA,
+	"default":    defaultValue,
+}
+
+func truncateText(n int, s string) string {
+	if runes := []rune(s); n >= 0 && len(runes) > n {
+		if n == 0 {
+			return ""
+		}
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
+
+func formatTimeIn(layout, tz string, t time.Time) (string, error) {
+	if t.IsZero() {
+		return "", nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return "", err
+	}
+	return t.In(loc).Format(layout), nil
+}
+
+func defaultValue(fallback, v interface{}) interface{} {
+	if v == nil {
+		return fallback
+	}
+	if rv := reflect.ValueOf(v); rv.IsZero() {
+		return fallback
+	}
+	return v
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("message").Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+}
+
+func renderMessage(text string, data MessageData) (string, error) {
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
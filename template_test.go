@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultTemplateStatuses(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+		bad    string
+	}{
+		{"QUEUED", "⏳ *api* on *main* is queued.", "finished"},
+		{"WORKING", "⏳ *api* on *main* is running.", "finished"},
+		{"SUCCESS", "✅ *api* on *main* *succeeded*.", "⏳"},
+		{"FAILURE", "❌ *api* on *main* *failed* at step *test*.", "⏳"},
+	}
+	for _, tt := range tests {
+		data := MessageData{Repo: "api", Branch: "main", Status: tt.status, ShortBuildId: "build-1"}
+		if tt.status == "FAILURE" {
+			data.FailureStep = "test"
+		}
+		got, err := renderMessage(defaultTemplate, data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.status, err)
+		}
+		if !strings.HasPrefix(got, tt.want) || strings.Contains(got, tt.bad) {
+			t.Errorf("%s build rendered as %q, want it to start with %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestBuiltinTemplatesUseStatusText(t *testing.T) {
+	templates := map[string]string{
+		"default":          defaultTemplate,
+		"superset failure": supersetFailureTemplate,
+		"quiet batch":      quietBatchTemplate,
+		"aggregate":        aggregateTemplate,
+		"cooldown summary": cooldownSummaryTemplate,
+		"release":          releaseTemplate,
+		"summary":          summaryTemplate,
+		"unconfigured":     unconfiguredRepoTemplate,
+		"project strand":   projectStrandFailureTemplate,
+	}
+	data := MessageData{
+		Repo: "api", Branch: "main", Tag: "v1.0.0", Status: "FAILURE", FailureStep: "test", Locale: "vi",
+		Builds: []AggregatedBuild{{Name: "api-test", Repo: "api", Branch: "main", Status: "FAILURE"}},
+	}
+	for name, text := range templates {
+		got, err := renderMessage(text, data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if strings.Contains(got, "FAILURE") || !strings.Contains(got, "thất bại") {
+			t.Errorf("%s template rendered %q, want the localized status", name, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const truncatedMarker = "… (truncated)"
+
+// limitedNotifier is implemented by notifiers whose provider rejects
+// messages above a maximum length (in characters).
+type limitedNotifier interface {
+	MaxLength() int
+}
+
+// truncateMessage shortens message to at most max characters, ending it with
+// truncatedMarker. It never cuts through a multi-byte character, an HTML
+// entity, a <...> link or mention, or a backslash escape, and closes a ```
+// block left open by the cut.
+func truncateMessage(message string, max int) string {
+	runes := []rune(message)
+	if max <= 0 || len(runes) <= max {
+		return message
+	}
+	// Leave room for the marker and a closing fence.
+	keep := max - len([]rune(truncatedMarker)) - len("```\n")
+	if keep <= 0 {
+		return string([]rune(truncatedMarker)[:max])
+	}
+	return endTruncated(string(runes[:keep]))
+}
+
+// endTruncated backs cut off a partial entity, link, escape or fence, closes
+// an open ``` block and appends truncatedMarker. The result is at most
+// len("\n```")+len(truncatedMarker) longer than cut.
+func endTruncated(cut string) string {
+	if i := strings.LastIndex(cut, "&"); i >= 0 && !strings.Contains(cut[i:], ";") && len(cut)-i <= 10 {
+		cut = cut[:i]
+	}
+	if i := strings.LastIndex(cut, "<"); i >= 0 && !strings.Contains(cut[i:], ">") {
+		cut = cut[:i]
+	}
+	if trailing := len(cut) - len(strings.TrimRight(cut, "\\")); trailing%2 == 1 {
+		cut = cut[:len(cut)-1]
+	}
+	// Drop a fence the cut may have split, then close any block left open.
+	cut = strings.TrimRight(cut, "`")
+	if strings.Count(cut, "```")%2 == 1 {
+		cut += "\n```"
+	}
+	return cut + truncatedMarker
+}
+
+// truncateMessageBytes is truncateMessage for providers that limit the
+// UTF-8 encoded size of a message rather than its characters.
+func truncateMessageBytes(message string, max int) string {
+	if max <= 0 || len(message) <= max {
+		return message
+	}
+	keep := max - len(truncatedMarker) - len("\n```")
+	for keep > 0 && !utf8.RuneStart(message[keep]) {
+		keep--
+	}
+	if keep <= 0 {
+		if len(truncatedMarker) <= max {
+			return truncatedMarker
+		}
+		return ""
+	}
+	return endTruncated(message[:keep])
+}
+
+// splitMessage cuts message into parts of at most max characters, at line
+// breaks where it can, for messages continued in a thread. A ``` block cut
+// between parts is closed at the end of one and reopened in the next.
+func splitMessage(message string, max int) []string {
+	var parts []string
+	open := false
+	for message != "" {
+		reopen := ""
+		if open {
+			reopen = "```"
+		}
+		room := max - len(reopen) - len("\n```")
+		if room <= 0 {
+			return []string{truncateMessage(message, max)}
+		}
+		part := message
+		if runes := []rune(message); len(runes) > room {
+			part = string(runes[:room])
+			if i := strings.LastIndex(part, "\n"); i > 0 {
+				part = part[:i+1]
+			}
+			// Don't split a fence.
+			if trimmed := strings.TrimRight(part, "`"); trimmed != "" {
+				part = trimmed
+			}
+		}
+		message = message[len(part):]
+		part = reopen + part
+		open = strings.Count(part, "```")%2 == 1
+		if open {
+			part = strings.TrimSuffix(part, "\n") + "\n```"
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
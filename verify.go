@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// verifyURL is the health check URL of a Verify rule; VerifyURL overrides
+// the deployment-wide VERIFY_URL.
+func (r *Rule) verifyURL() string {
+	if r.VerifyURL != "" {
+		return r.VerifyURL
+	}
+	return os.Getenv("VERIFY_URL")
+}
+
+// verifyDeploy checks that a deployment came up by requesting its health URL,
+// giving up after VERIFY_TIMEOUT. Without a URL there is nothing to check.
+func verifyDeploy(ctx context.Context, url string) error {
+	if url == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, getEnvDuration("VERIFY_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := sharedHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", url, res.StatusCode)
+	}
+	return nil
+}
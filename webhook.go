@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// webhookHosts are the hosts each channel type is expected to send to. Other
+// hosts are allowed, e.g. chat-compatible webhooks or an Opsgenie proxy, but
+// logged as a likely typo.
+var webhookHosts = map[string][]string{
+	"hangout":  {"chat.googleapis.com"},
+	"opsgenie": {"api.opsgenie.com", "api.eu.opsgenie.com"},
+}
+
+// checkWebhooks validates the URL of every channel at startup and logs it
+// redacted, so a mistyped webhook fails the start instead of the first
+// build. URLs that don't parse, lack a host or aren't https (except to
+// localhost) are errors; an unexpected host or a missing URL is logged.
+func (c *Config) checkWebhooks() error {
+	urls := map[string]string{}
+	types := map[string]string{}
+	for name, u := range c.HangoutURLs {
+		urls[name], types[name] = u, "hangout"
+	}
+	for name, cc := range c.Channels {
+		urls[name], types[name] = cc.url(), cc.Type
+		for i, u := range cc.BackupURLs {
+			backup := fmt.Sprintf("%s backup %d", name, i+1)
+			urls[backup], types[backup] = u, cc.Type
+		}
+	}
+	if _, ok := urls[legacyChannel]; !ok {
+		urls[legacyChannel], types[legacyChannel] = os.Getenv("HANGOUT_URL"), "hangout"
+	}
+	names := make([]string, 0, len(urls))
+	for name := range urls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		raw, typ := urls[name], types[name]
+		switch {
+		case raw == "" && typ == "opsgenie":
+			raw = opsgenieAPI
+		case raw == "":
+			// The legacy channel is only used by rules without channels.
+			if name != legacyChannel {
+				log.Printf("Channel %s (%s) has no URL", name, typ)
+			}
+			continue
+		case typ == "sns":
+			if !strings.HasPrefix(raw, "arn:aws:sns:") {
+				errs = append(errs, fmt.Errorf("channel %s: %q is not an SNS topic ARN", name, raw))
+			}
+			continue
+		}
+		u, err := checkWebhookURL(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("channel %s: %v", name, err))
+			continue
+		}
+		if hosts, ok := webhookHosts[typ]; ok && !contains(hosts, u.Hostname()) {
+			log.Printf("Channel %s (%s) sends to unexpected host %s, expected %s", name, typ, u.Hostname(), strings.Join(hosts, " or "))
+		}
+		log.Printf("Channel %s (%s) sends to %s", name, typ, redactURL(u))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: invalid webhook: %v", ErrConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+// checkWebhookURL parses a webhook URL, without its secrets in the error.
+func checkWebhookURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, errors.New("URL does not parse")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %s has no host", redactURL(u))
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLocalhost(u.Hostname())) {
+		return nil, fmt.Errorf("URL %s must use https", redactURL(u))
+	}
+	return u, nil
+}
+
+// redactRawURL is redactURL for a URL that may not parse.
+func redactRawURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedMarker
+	}
+	return redactURL(u)
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redactURL shows the scheme and host of a webhook, with the path elided
+// and query values masked, e.g.
+// "https://chat.googleapis.com/…?key=[REDACTED]&token=[REDACTED]".
+func redactURL(u *url.URL) string {
+	s := u.Scheme + "://" + u.Host
+	if u.Path != "" && u.Path != "/" {
+		s += "/…"
+	}
+	query := u.Query()
+	if len(query) == 0 {
+		return s
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key+"="+redactedMarker)
+	}
+	sort.Strings(keys)
+	return s + "?" + strings.Join(keys, "&")
+}